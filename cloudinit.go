@@ -0,0 +1,129 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+const (
+	// cloud-init only looks at seed media labelled like this
+	seedVolumeLabel = "cidata"
+
+	metaDataTemplate = `instance-id: %s
+local-hostname: %s
+`
+	userDataTemplate = `#cloud-config
+hostname: %s
+users:
+  - name: %s
+    sudo: ALL=(ALL) NOPASSWD:ALL
+    shell: /bin/bash
+    lock_passwd: true
+    ssh_authorized_keys:
+      - %s
+ssh_pwauth: false
+`
+	// Bring up both NICs, not just the first one cloud-init would pick
+	networkConfigTemplate = `version: 2
+ethernets:
+  public:
+    match:
+      macaddress: '%s'
+    dhcp4: true
+  private:
+    match:
+      macaddress: '%s'
+    dhcp4: true
+`
+	// Extra NICs may sit on networks without DHCP, don't wait for them
+	networkConfigExtraTemplate = `  extra%d:
+    match:
+      macaddress: '%s'
+    dhcp4: true
+    optional: true
+`
+)
+
+// Name of the cloud-init seed ISO inside the storage pool
+func (d *Driver) seedVolumeName() string {
+	return fmt.Sprintf("%s-%s", d.MachineName, seedFilename)
+}
+
+// The NoCloud seed telling cloud-init how to set up the guest for
+// docker-machine: hostname, SSH user and key, and networking
+func (d *Driver) cloudInitSeed() ([]byte, error) {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{
+		"meta-data": []byte(fmt.Sprintf(metaDataTemplate, d.MachineName, d.MachineName)),
+		"user-data": []byte(fmt.Sprintf(userDataTemplate, d.MachineName, d.GetSSHUsername(),
+			strings.TrimSpace(string(pubKey)))),
+		"network-config": []byte(d.networkConfig()),
+	}
+	var seed bytes.Buffer
+	if err := writeISO9660(&seed, seedVolumeLabel, files, time.Now()); err != nil {
+		return nil, err
+	}
+	return seed.Bytes(), nil
+}
+
+func (d *Driver) networkConfig() string {
+	config := fmt.Sprintf(networkConfigTemplate, d.PublicMAC, d.PrivateMAC)
+	for i, nic := range d.ExtraNetworks {
+		config += fmt.Sprintf(networkConfigExtraTemplate, i+1, nic.MAC)
+	}
+	return config
+}
+
+// Write the seed ISO next to the other artifacts, or upload it to the
+// storage pool when libvirtd can't see them
+func (d *Driver) createSeed(layout artifactLayout) error {
+	seed, err := d.cloudInitSeed()
+	if err != nil {
+		return err
+	}
+	if d.SeedVolume != "" {
+		log.Infof("Uploading cloud-init seed to storage pool %s...", d.StoragePool)
+		pool, err := d.getStoragePool()
+		if err != nil {
+			return err
+		}
+		defer pool.Free()
+		vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, d.SeedVolume, len(seed), diskFormatRaw), 0)
+		if err != nil {
+			log.Warnf("Failed to create volume %s: %s", d.SeedVolume, err)
+			return err
+		}
+		defer vol.Free()
+		return d.uploadToVolume(vol, bytes.NewReader(seed), uint64(len(seed)))
+	}
+	log.Debugf("Writing cloud-init seed to %s", layout.local(seedFilename))
+	if err := ioutil.WriteFile(layout.local(seedFilename), seed, 0644); err != nil {
+		return err
+	}
+	d.SeedISO = layout.host(seedFilename)
+	return layout.setPermissions(seedFilename)
+}
+
+// Create the machine disk as an overlay of the cloud image, which is kept
+// in the image cache and uploaded to the storage pool once
+func (d *Driver) createCloudImageVolume() error {
+	cache := OpenImageCache(d.StorePath)
+	blob, digest, err := cache.Fetch(d.CloudImage, "", d.ImageMirror, d.ImageChecksum)
+	if err != nil {
+		return err
+	}
+	base, err := d.imageVolume(cache, blob, digest)
+	if err != nil {
+		return err
+	}
+	defer base.Free()
+	return d.createOverlayVolume(base)
+}
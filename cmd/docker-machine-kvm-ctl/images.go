@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/steve-fraser/docker-machine-kvm"
+)
+
+const imagesUsage = `Usage: docker-machine-kvm-ctl images COMMAND
+
+Commands:
+  list   List cached images and the storage pool volumes made from them
+  prune  Remove cached images and volumes no machine uses
+`
+
+func images(storePath string, args []string) error {
+	if len(args) != 1 {
+		return usageError(imagesUsage)
+	}
+	cache := kvm.OpenImageCache(storePath)
+
+	switch args[0] {
+	case "list":
+		list, err := cache.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "DIGEST\tSIZE\tSOURCES\tVOLUMES")
+		for _, img := range list {
+			var volumes []string
+			for _, v := range img.Volumes {
+				volumes = append(volumes, fmt.Sprintf("%s/%s", v.StoragePool, v.Volume))
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", img.Digest[:12], img.Size,
+				strings.Join(img.Sources, ", "), strings.Join(volumes, ", "))
+		}
+		return w.Flush()
+	case "prune":
+		removed, err := cache.Prune()
+		for _, r := range removed {
+			fmt.Printf("Removed %s\n", r)
+		}
+		return err
+	}
+	return usageError(imagesUsage)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+const interfacesUsage = `Usage: docker-machine-kvm-ctl interfaces MACHINE
+
+List the network interfaces of a machine with their addresses.
+`
+
+func interfaces(storePath string, args []string) error {
+	if len(args) != 1 {
+		return usageError(interfacesUsage)
+	}
+	d, _, err := loadDriver(storePath, args[0])
+	if err != nil {
+		return err
+	}
+	nics, err := d.Interfaces()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNETWORK\tMAC\tADDRESS")
+	for _, nic := range nics {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", nic.Type, nic.Network, nic.MAC, nic.Address)
+	}
+	return w.Flush()
+}
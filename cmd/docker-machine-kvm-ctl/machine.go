@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/steve-fraser/docker-machine-kvm"
+)
+
+func defaultStorePath() string {
+	if path := os.Getenv("MACHINE_STORAGE_PATH"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "machine")
+}
+
+// A docker-machine host config, keeping everything but the driver as is
+type machineConfig struct {
+	path   string
+	fields map[string]json.RawMessage
+}
+
+func configPath(storePath, name string) string {
+	return filepath.Join(storePath, "machines", name, "config.json")
+}
+
+// Load the kvm driver of a machine from its docker-machine config
+func loadDriver(storePath, name string) (*kvm.Driver, *machineConfig, error) {
+	cfg := &machineConfig{path: configPath(storePath, name)}
+	data, err := ioutil.ReadFile(cfg.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load machine %s: %s", name, err)
+	}
+	if err := json.Unmarshal(data, &cfg.fields); err != nil {
+		return nil, nil, fmt.Errorf("malformed config %s: %s", cfg.path, err)
+	}
+	var driverName string
+	if err := json.Unmarshal(cfg.fields["DriverName"], &driverName); err != nil || driverName != "kvm" {
+		return nil, nil, fmt.Errorf("machine %s doesn't use the kvm driver", name)
+	}
+	d := kvm.NewDriver(name, storePath).(*kvm.Driver)
+	if err := json.Unmarshal(cfg.fields["Driver"], d); err != nil {
+		return nil, nil, fmt.Errorf("malformed driver config in %s: %s", cfg.path, err)
+	}
+	return d, cfg, nil
+}
+
+// Write changes to the driver back to the machine config
+func (cfg *machineConfig) save(d *kvm.Driver) error {
+	driver, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	cfg.fields["Driver"] = driver
+	data, err := json.MarshalIndent(cfg.fields, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cfg.path, data, 0600)
+}
@@ -0,0 +1,65 @@
+// docker-machine-kvm-ctl manages the KVM specific parts of machines created
+// with the kvm driver that docker-machine itself has no commands for.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: docker-machine-kvm-ctl [-s STORAGE_PATH] COMMAND [ARGS]
+
+Commands:
+  images      Manage the image cache
+  interfaces  List the network interfaces of a machine
+  resize      Grow the disk of a machine
+  snapshot    Manage machine snapshots
+  template    Manage templates for linked clones
+
+Run 'docker-machine-kvm-ctl COMMAND' for the usage of a command.
+`
+
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+func main() {
+	storePath := flag.String("s", defaultStorePath(), "docker-machine storage path")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args := flag.Args(); args[0] {
+	case "images":
+		err = images(*storePath, args[1:])
+	case "interfaces":
+		err = interfaces(*storePath, args[1:])
+	case "resize":
+		err = resize(*storePath, args[1:])
+	case "snapshot":
+		err = snapshot(*storePath, args[1:])
+	case "template":
+		err = template(*storePath, args[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprint(os.Stderr, err)
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const resizeUsage = `Usage: docker-machine-kvm-ctl resize MACHINE SIZE
+
+Grow the disk of a machine to SIZE MB. Running machines are resized live,
+boot2docker machines grow their filesystem on their next start.
+`
+
+func resize(storePath string, args []string) error {
+	if len(args) != 2 {
+		return usageError(resizeUsage)
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid size %q, expected MB", args[1])
+	}
+	d, cfg, err := loadDriver(storePath, args[0])
+	if err != nil {
+		return err
+	}
+	if err := d.ResizeDisk(size); err != nil {
+		return err
+	}
+	return cfg.save(d)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+const snapshotUsage = `Usage: docker-machine-kvm-ctl snapshot COMMAND MACHINE [ARGS]
+
+Commands:
+  create MACHINE NAME [DESCRIPTION]  Take a snapshot
+  list MACHINE                       List snapshots
+  revert MACHINE NAME                Revert to a snapshot
+  delete MACHINE NAME                Delete a snapshot
+`
+
+func snapshot(storePath string, args []string) error {
+	if len(args) < 2 {
+		return usageError(snapshotUsage)
+	}
+	command, machine, args := args[0], args[1], args[2:]
+	d, cfg, err := loadDriver(storePath, machine)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case command == "create" && len(args) >= 1:
+		return d.CreateSnapshot(args[0], strings.Join(args[1:], " "))
+	case command == "list" && len(args) == 0:
+		snaps, err := d.ListSnapshots()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tSTATE\tCURRENT\tDESCRIPTION")
+		for _, s := range snaps {
+			current := ""
+			if s.Current {
+				current = "*"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.Name, s.Created.Format("2006-01-02 15:04:05"), s.State, current, s.Description)
+		}
+		return w.Flush()
+	case command == "revert" && len(args) == 1:
+		if err := d.RevertSnapshot(args[0]); err != nil {
+			return err
+		}
+		return cfg.save(d)
+	case command == "delete" && len(args) == 1:
+		return d.DeleteSnapshot(args[0])
+	}
+	return usageError(snapshotUsage)
+}
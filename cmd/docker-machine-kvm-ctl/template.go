@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/steve-fraser/docker-machine-kvm"
+)
+
+const templateUsage = `Usage: docker-machine-kvm-ctl template COMMAND [ARGS]
+
+Commands:
+  create MACHINE NAME  Create a template from a stopped machine
+  list                 List templates and the volumes cloned from them
+  delete NAME          Delete a template no volume is cloned from
+`
+
+func template(storePath string, args []string) error {
+	if len(args) < 1 {
+		return usageError(templateUsage)
+	}
+	command, args := args[0], args[1:]
+
+	switch {
+	case command == "create" && len(args) == 2:
+		d, _, err := loadDriver(storePath, args[0])
+		if err != nil {
+			return err
+		}
+		return d.CreateTemplate(args[1])
+	case command == "list" && len(args) == 0:
+		templates, err := kvm.ListTemplates(storePath)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tPOOL\tVOLUME\tSOURCE\tCLONES")
+		for _, t := range templates {
+			clones, err := t.Clones()
+			cloneList := strings.Join(clones, ", ")
+			if err != nil {
+				cloneList = fmt.Sprintf("error: %s", err)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.Name, t.StoragePool, t.Volume, t.SourceMachine, cloneList)
+		}
+		return w.Flush()
+	case command == "delete" && len(args) == 1:
+		t, err := kvm.LoadTemplate(storePath, args[0])
+		if err != nil {
+			return err
+		}
+		return t.Delete()
+	}
+	return usageError(templateUsage)
+}
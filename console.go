@@ -0,0 +1,74 @@
+package kvm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// pty for virsh console, logged to a file by virtlogd
+	serialConsoleLog = "log"
+	// Written straight to a file by qemu
+	serialConsoleFile = "file"
+	// pty for virsh console only
+	serialConsolePty  = "pty"
+	serialConsoleNone = "none"
+
+	// Where the console log goes when libvirtd runs on another host
+	remoteConsoleLogDir = "/var/log/libvirt/qemu"
+)
+
+func validateSerialConsole(mode string) error {
+	switch mode {
+	case serialConsoleLog, serialConsoleFile, serialConsolePty, serialConsoleNone:
+		return nil
+	}
+	return fmt.Errorf("unsupported serial console mode %q, expected %s, %s, %s or %s",
+		mode, serialConsoleLog, serialConsoleFile, serialConsolePty, serialConsoleNone)
+}
+
+// Whether the serial console ends up in ConsoleLog
+func (d *Driver) consoleLogged() bool {
+	return d.SerialConsole == serialConsoleLog || d.SerialConsole == serialConsoleFile
+}
+
+// Path of the console log as seen by libvirtd
+func (d *Driver) hostConsoleLog() string {
+	if d.isRemote() {
+		return fmt.Sprintf("%s/%s-%s", remoteConsoleLogDir, d.MachineName, consoleLogFilename)
+	}
+	return d.layout().hostConsoleLog()
+}
+
+// ConsoleTail returns the last n lines the guest wrote to its serial
+// console, for diagnosing guests that hang during boot
+func (d *Driver) ConsoleTail(n int) ([]string, error) {
+	if !d.consoleLogged() {
+		return nil, errors.New("the serial console of this machine isn't logged")
+	}
+	if d.isRemote() {
+		return nil, fmt.Errorf("the serial console is logged to %s on the libvirtd host", d.ConsoleLog)
+	}
+	return tailFile(d.layout().consoleLog(), n)
+}
+
+func tailFile(path string, n int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, scanner.Err()
+}
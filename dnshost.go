@@ -0,0 +1,85 @@
+package kvm
+
+import (
+	"encoding/xml"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// Names the machine resolves as on the private network
+func (d *Driver) dnsHostnames() []string {
+	names := []string{d.MachineName}
+	if d.PrivateNetworkDomain != "" {
+		names = append(names, d.MachineName+"."+d.PrivateNetworkDomain)
+	}
+	return names
+}
+
+// Whether a DNS host record belongs to the machine, going by its address
+// or its name
+func (d *Driver) ownsDNSHost(host networkDNSHost) bool {
+	if host.IP == d.PrivateIP {
+		return true
+	}
+	for _, name := range host.Hostnames {
+		if name == d.MachineName {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a DNS host record for the reserved address of the machine to the
+// private network, replacing any left behind by an earlier machine of the
+// same name or address
+func (d *Driver) registerDNSHost() error {
+	network, nw, err := d.privateNetworkDef()
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	for _, host := range nw.dnsHosts() {
+		if !d.ownsDNSHost(host) {
+			continue
+		}
+		log.Debugf("Replacing DNS record %s of %v", host.IP, host.Hostnames)
+		if err := updateDNSHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, host); err != nil {
+			return err
+		}
+	}
+	host := networkDNSHost{IP: d.PrivateIP, Hostnames: d.dnsHostnames()}
+	log.Infof("Registering %v on network %s...", host.Hostnames, d.PrivateNetwork)
+	return updateDNSHost(network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, host)
+}
+
+// Drop the DNS host records of the machine, warning on failure like
+// releasePrivateIP
+func (d *Driver) unregisterDNSHost() {
+	if d.PrivateIP == "" {
+		return
+	}
+	network, nw, err := d.privateNetworkDef()
+	if err != nil {
+		log.Warnf("Unable to remove DNS records of %s: %s", d.MachineName, err)
+		return
+	}
+	defer network.Free()
+	for _, host := range nw.dnsHosts() {
+		if !d.ownsDNSHost(host) {
+			continue
+		}
+		if err := updateDNSHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, host); err != nil {
+			log.Warnf("Unable to remove DNS record %s of %s: %s", host.IP, d.MachineName, err)
+		}
+	}
+}
+
+func updateDNSHost(network *libvirt.Network, cmd libvirt.NetworkUpdateCommand, host networkDNSHost) error {
+	data, err := xml.Marshal(host)
+	if err != nil {
+		return err
+	}
+	return network.Update(cmd, libvirt.NETWORK_SECTION_DNS_HOST, -1, string(data), networkUpdateFlags)
+}
@@ -0,0 +1,104 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// Entry of the JSON status file libvirt's leaseshelper maintains next to,
+// or on newer versions instead of, the dnsmasq lease file:
+//
+//	[
+//	  {
+//	    "ip-address": "192.168.42.23",
+//	    "mac-address": "52:54:00:d2:3f:ba",
+//	    "hostname": "boot2docker",
+//	    "expiry-time": 1464094612
+//	  }
+//	]
+type dnsmasqStatusEntry struct {
+	IPAddress  string `json:"ip-address"`
+	MACAddress string `json:"mac-address"`
+	Hostname   string `json:"hostname"`
+	ExpiryTime int64  `json:"expiry-time"`
+}
+
+func (e dnsmasqStatusEntry) expiry() time.Time {
+	return time.Unix(e.ExpiryTime, 0)
+}
+
+// Leases with an expiry time of 0 never expire
+func (e dnsmasqStatusEntry) expired(now time.Time) bool {
+	return e.ExpiryTime != 0 && e.expiry().Before(now)
+}
+
+func parseDnsmasqStatus(data []byte) ([]dnsmasqStatusEntry, error) {
+	var entries []dnsmasqStatusEntry
+	if len(bytes.TrimSpace(data)) == 0 {
+		return entries, nil
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("malformed dnsmasq status file: %s", err)
+	}
+	return entries, nil
+}
+
+// The address of the newest unexpired lease held by mac. A guest can hold
+// several after reboots, the one expiring last is the current one
+func newestStatusLease(entries []dnsmasqStatusEntry, mac string, now time.Time) string {
+	var newest *dnsmasqStatusEntry
+	for i, e := range entries {
+		if !strings.EqualFold(e.MACAddress, mac) || e.expired(now) {
+			continue
+		}
+		if newest == nil || e.ExpiryTime == 0 || (newest.ExpiryTime != 0 && e.ExpiryTime > newest.ExpiryTime) {
+			newest = &entries[i]
+		}
+	}
+	if newest == nil {
+		return ""
+	}
+	return newest.IPAddress
+}
+
+func (d *Driver) getIPByMACFromStatusFile(mac string) (string, error) {
+	statusFile := fmt.Sprintf(dnsmasqStatus, d.PrivateNetwork)
+	data, err := ioutil.ReadFile(statusFile)
+	if err != nil {
+		log.Debugf("Failed to retrieve dnsmasq status from %s", statusFile)
+		return "", err
+	}
+	entries, err := parseDnsmasqStatus(data)
+	if err != nil {
+		return "", err
+	}
+	ip := newestStatusLease(entries, mac, time.Now())
+	if ip != "" {
+		log.Debugf("IP address: %s", ip)
+	}
+	return ip, nil
+}
+
+// Depending on the libvirt version leases end up in the JSON status file,
+// the dnsmasq lease file or both, so try them in turn
+func (d *Driver) getIPByMACFromDnsmasq(mac string) (string, error) {
+	if d.isRemote() {
+		// The files live on the libvirtd host
+		return "", nil
+	}
+	ip, statusErr := d.getIPByMACFromStatusFile(mac)
+	if ip != "" {
+		return ip, nil
+	}
+	ip, err := d.getIPByMACFromLeaseFile(mac)
+	if err != nil && statusErr != nil {
+		return "", err
+	}
+	return ip, nil
+}
@@ -0,0 +1,95 @@
+package kvm
+
+import (
+	"testing"
+	"time"
+)
+
+const testStatus = `[
+  {
+    "ip-address": "192.168.42.23",
+    "mac-address": "52:54:00:d2:3f:ba",
+    "hostname": "boot2docker",
+    "expiry-time": 1000
+  },
+  {
+    "ip-address": "192.168.42.24",
+    "mac-address": "52:54:00:D2:3F:BA",
+    "expiry-time": 2000
+  },
+  {
+    "ip-address": "192.168.42.30",
+    "mac-address": "52:54:00:00:00:01",
+    "expiry-time": 500
+  },
+  {
+    "ip-address": "192.168.42.40",
+    "mac-address": "52:54:00:00:00:02",
+    "expiry-time": 0
+  },
+  {
+    "ip-address": "192.168.42.41",
+    "mac-address": "52:54:00:00:00:02",
+    "expiry-time": 3000
+  }
+]`
+
+func TestParseDnsmasqStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		entries int
+		wantErr bool
+	}{
+		{name: "empty file", data: "", entries: 0},
+		{name: "whitespace", data: " \n", entries: 0},
+		{name: "empty list", data: "[]", entries: 0},
+		{name: "leases", data: testStatus, entries: 5},
+		{name: "truncated", data: `[{"ip-address": "192.168.42.23"`, wantErr: true},
+		{name: "not a list", data: `{"ip-address": "192.168.42.23"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := parseDnsmasqStatus([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", entries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != tt.entries {
+				t.Errorf("got %d entries, want %d", len(entries), tt.entries)
+			}
+		})
+	}
+}
+
+func TestNewestStatusLease(t *testing.T) {
+	entries, err := parseDnsmasqStatus([]byte(testStatus))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		mac  string
+		now  int64
+		want string
+	}{
+		{name: "latest expiry wins", mac: "52:54:00:d2:3f:ba", now: 100, want: "192.168.42.24"},
+		{name: "case insensitive", mac: "52:54:00:D2:3F:BA", now: 100, want: "192.168.42.24"},
+		{name: "expired skipped", mac: "52:54:00:d2:3f:ba", now: 1500, want: "192.168.42.24"},
+		{name: "all expired", mac: "52:54:00:00:00:01", now: 600, want: ""},
+		{name: "infinite lease wins", mac: "52:54:00:00:00:02", now: 100, want: "192.168.42.40"},
+		{name: "unknown MAC", mac: "52:54:00:00:00:03", now: 100, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newestStatusLease(entries, tt.mac, time.Unix(tt.now, 0)); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,465 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+const qemuNamespace = "http://libvirt.org/schemas/domain/qemu/1.0"
+
+// Name of the virtio channel qemu-guest-agent listens on
+const guestAgentChannel = "org.qemu.guest_agent.0"
+
+const (
+	diskBusIDE    = "ide"
+	diskBusSATA   = "sata"
+	diskBusVirtio = "virtio"
+	diskBusSCSI   = "scsi"
+)
+
+var (
+	cacheModes        = []string{"default", "none", "writethrough", "writeback", "directsync", "unsafe"}
+	ioModes           = []string{"threads", "native"}
+	diskBuses         = []string{diskBusIDE, diskBusSATA, diskBusVirtio, diskBusSCSI}
+	discardModes      = []string{"", "ignore", "unmap"}
+	detectZeroesModes = []string{"", "off", "on", "unmap"}
+)
+
+// The parts of the libvirt domain format the driver generates. Values are
+// escaped by encoding/xml, so nothing a user passes can alter the
+// structure of the definition
+type domainDef struct {
+	XMLName  xml.Name       `xml:"domain"`
+	Type     string         `xml:"type,attr"`
+	QemuNS   string         `xml:"xmlns:qemu,attr,omitempty"`
+	Name     string         `xml:"name"`
+	Memory   domainMemory   `xml:"memory"`
+	VCPU     int            `xml:"vcpu"`
+	Features domainFeatures `xml:"features"`
+	CPU      domainCPU      `xml:"cpu"`
+	OS       domainOS       `xml:"os"`
+	SysInfo  *domainSysInfo `xml:"sysinfo"`
+	Devices  domainDevices  `xml:"devices"`
+	// Extra qemu arguments, needs QemuNS to be set
+	QemuCommandline *qemuCommandline `xml:"qemu:commandline,omitempty"`
+}
+
+type domainMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type domainFeatures struct {
+	ACPI *struct{} `xml:"acpi"`
+	APIC *struct{} `xml:"apic"`
+	PAE  *struct{} `xml:"pae"`
+}
+
+type domainCPU struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type domainOS struct {
+	Type     string         `xml:"type"`
+	Boot     []domainBoot   `xml:"boot"`
+	BootMenu domainBootMenu `xml:"bootmenu"`
+	BIOS     *domainBIOS    `xml:"bios"`
+}
+
+type domainBoot struct {
+	Dev string `xml:"dev,attr"`
+}
+
+type domainBootMenu struct {
+	Enable string `xml:"enable,attr"`
+}
+
+type domainBIOS struct {
+	UseSerial string `xml:"useserial,attr"`
+}
+
+// XML structure:
+//
+//	<sysinfo type='fwcfg'>
+//	    <entry name='opt/com.coreos/config' file='/path/to/config.ign'/>
+//	</sysinfo>
+type domainSysInfo struct {
+	Type    string               `xml:"type,attr"`
+	Entries []domainSysInfoEntry `xml:"entry"`
+}
+
+type domainSysInfoEntry struct {
+	Name string `xml:"name,attr"`
+	File string `xml:"file,attr"`
+}
+
+type domainDevices struct {
+	Disks       []domainDisk       `xml:"disk"`
+	Controllers []domainController `xml:"controller"`
+	Graphics    []domainGraphics   `xml:"graphics"`
+	Serials     []domainSerial     `xml:"serial"`
+	Consoles    []domainConsole    `xml:"console"`
+	Interfaces  []domainInterface  `xml:"interface"`
+	Channels    []domainChannel    `xml:"channel"`
+}
+
+type domainDisk struct {
+	Type     string            `xml:"type,attr"`
+	Device   string            `xml:"device,attr"`
+	Driver   *domainDiskDriver `xml:"driver"`
+	Source   domainDiskSource  `xml:"source"`
+	Target   domainDiskTarget  `xml:"target"`
+	ReadOnly *struct{}         `xml:"readonly"`
+}
+
+type domainDiskDriver struct {
+	Name         string `xml:"name,attr"`
+	Type         string `xml:"type,attr"`
+	Cache        string `xml:"cache,attr,omitempty"`
+	IO           string `xml:"io,attr,omitempty"`
+	Discard      string `xml:"discard,attr,omitempty"`
+	DetectZeroes string `xml:"detect_zeroes,attr,omitempty"`
+}
+
+type domainDiskSource struct {
+	File   string `xml:"file,attr,omitempty"`
+	Dev    string `xml:"dev,attr,omitempty"`
+	Pool   string `xml:"pool,attr,omitempty"`
+	Volume string `xml:"volume,attr,omitempty"`
+}
+
+type domainDiskTarget struct {
+	Dev string `xml:"dev,attr"`
+	Bus string `xml:"bus,attr"`
+}
+
+type domainController struct {
+	Type  string `xml:"type,attr"`
+	Index int    `xml:"index,attr"`
+	Model string `xml:"model,attr,omitempty"`
+}
+
+type domainGraphics struct {
+	Type      string                 `xml:"type,attr"`
+	AutoPort  string                 `xml:"autoport,attr,omitempty"`
+	WebSocket string                 `xml:"websocket,attr,omitempty"`
+	Listen    string                 `xml:"listen,attr,omitempty"`
+	Listens   []domainGraphicsListen `xml:"listen"`
+}
+
+type domainGraphicsListen struct {
+	Type    string `xml:"type,attr"`
+	Address string `xml:"address,attr,omitempty"`
+}
+
+type domainSerial struct {
+	Type   string            `xml:"type,attr"`
+	Source *domainCharSource `xml:"source"`
+	Log    *domainCharLog    `xml:"log"`
+	Target domainCharTarget  `xml:"target"`
+}
+
+type domainConsole struct {
+	Type   string           `xml:"type,attr"`
+	Target domainCharTarget `xml:"target"`
+}
+
+type domainCharSource struct {
+	Path   string `xml:"path,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+type domainCharLog struct {
+	File   string `xml:"file,attr"`
+	Append string `xml:"append,attr,omitempty"`
+}
+
+// XML structure:
+//
+//	<channel type='unix'>
+//	    <source mode='bind'/>
+//	    <target type='virtio' name='org.qemu.guest_agent.0'/>
+//	</channel>
+type domainChannel struct {
+	Type   string              `xml:"type,attr"`
+	Source domainChannelSource `xml:"source"`
+	Target domainChannelTarget `xml:"target"`
+}
+
+type domainChannelSource struct {
+	Mode string `xml:"mode,attr"`
+}
+
+type domainChannelTarget struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:"name,attr"`
+}
+
+type domainCharTarget struct {
+	Type string `xml:"type,attr,omitempty"`
+	Port int    `xml:"port,attr"`
+}
+
+type domainInterface struct {
+	Type        string                `xml:"type,attr"`
+	MAC         *domainMAC            `xml:"mac"`
+	Source      domainInterfaceSource `xml:"source"`
+	VirtualPort *domainVirtualPort    `xml:"virtualport"`
+	VLAN        *domainVLAN           `xml:"vlan"`
+	Model       *domainModel          `xml:"model"`
+}
+
+type domainMAC struct {
+	Address string `xml:"address,attr"`
+}
+
+type domainInterfaceSource struct {
+	Network   string `xml:"network,attr,omitempty"`
+	Bridge    string `xml:"bridge,attr,omitempty"`
+	Dev       string `xml:"dev,attr,omitempty"`
+	Mode      string `xml:"mode,attr,omitempty"`
+	Portgroup string `xml:"portgroup,attr,omitempty"`
+}
+
+type domainVirtualPort struct {
+	Type       string                       `xml:"type,attr"`
+	Parameters *domainVirtualPortParameters `xml:"parameters"`
+}
+
+type domainVirtualPortParameters struct {
+	InterfaceID string `xml:"interfaceid,attr,omitempty"`
+}
+
+type domainVLAN struct {
+	Trunk string          `xml:"trunk,attr,omitempty"`
+	Tags  []domainVLANTag `xml:"tag"`
+}
+
+type domainVLANTag struct {
+	ID int `xml:"id,attr"`
+}
+
+type domainModel struct {
+	Type string `xml:"type,attr"`
+}
+
+type qemuCommandline struct {
+	Args []qemuArg `xml:"qemu:arg"`
+}
+
+type qemuArg struct {
+	Value string `xml:"value,attr"`
+}
+
+func oneOf(value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the values that end up in the domain definition, so a typo fails
+// PreCreateCheck rather than DomainDefineXML halfway through Create
+func (d *Driver) validateDomainOptions() error {
+	if d.Memory <= 0 {
+		return fmt.Errorf("invalid memory size %d MB", d.Memory)
+	}
+	if d.CPU <= 0 {
+		return fmt.Errorf("invalid CPU count %d", d.CPU)
+	}
+	if !oneOf(d.CacheMode, cacheModes) {
+		return fmt.Errorf("unsupported disk cache mode %q, expected one of %v", d.CacheMode, cacheModes)
+	}
+	if !oneOf(d.IOMode, ioModes) {
+		return fmt.Errorf("unsupported disk IO mode %q, expected one of %v", d.IOMode, ioModes)
+	}
+	// qemu only does native AIO on files opened with O_DIRECT
+	if d.IOMode == "native" && d.CacheMode != "none" && d.CacheMode != "directsync" {
+		return fmt.Errorf("disk IO mode native needs cache mode none or directsync, not %s", d.CacheMode)
+	}
+	if !oneOf(d.DiskBus, diskBuses) {
+		return fmt.Errorf("unsupported disk bus %q, expected one of %v", d.DiskBus, diskBuses)
+	}
+	if !oneOf(d.DiskDiscard, discardModes) {
+		return fmt.Errorf("unsupported disk discard mode %q, expected ignore or unmap", d.DiskDiscard)
+	}
+	if !oneOf(d.DiskDetectZeroes, detectZeroesModes) {
+		return fmt.Errorf("unsupported disk detect_zeroes mode %q, expected off, on or unmap", d.DiskDetectZeroes)
+	}
+	if d.DiskDetectZeroes == "unmap" && d.DiskDiscard != "unmap" {
+		return fmt.Errorf("disk detect_zeroes mode unmap needs discard mode unmap")
+	}
+	return nil
+}
+
+// Target name of the index-th disk on bus. The machine disk is always the
+// first one, so whatever the bus the guest sees it as its first disk
+// (sda, or vda on virtio) and boot2docker's automount finds the format-me
+// payload on it
+func diskTarget(bus string, index int) string {
+	prefix := "sd"
+	switch bus {
+	case diskBusIDE, "":
+		prefix = "hd"
+	case diskBusVirtio:
+		prefix = "vd"
+	}
+	return fmt.Sprintf("%s%c", prefix, 'a'+index)
+}
+
+func (d *Driver) diskBus() string {
+	if d.DiskBus == "" {
+		return diskBusIDE
+	}
+	return d.DiskBus
+}
+
+// A disk backed by a volume of the storage pool when there is one, or by
+// a file on the libvirtd host
+func (d *Driver) diskSource(volume, file string) (string, domainDiskSource) {
+	if volume != "" {
+		return "volume", domainDiskSource{Pool: d.StoragePool, Volume: volume}
+	}
+	return "file", domainDiskSource{File: file}
+}
+
+func (d *Driver) cdrom(volume, file, dev string) domainDisk {
+	typ, src := d.diskSource(volume, file)
+	return domainDisk{
+		Type:     typ,
+		Device:   "cdrom",
+		Source:   src,
+		Target:   domainDiskTarget{Dev: dev, Bus: "ide"},
+		ReadOnly: &struct{}{},
+	}
+}
+
+func (d *Driver) domainDef() *domainDef {
+	def := &domainDef{
+		Type:   "kvm",
+		Name:   d.MachineName,
+		Memory: domainMemory{Unit: "M", Value: d.Memory},
+		VCPU:   d.CPU,
+		Features: domainFeatures{
+			ACPI: &struct{}{},
+			APIC: &struct{}{},
+			PAE:  &struct{}{},
+		},
+		CPU: domainCPU{Mode: "host-passthrough"},
+	}
+
+	def.OS.Type = "hvm"
+	if d.CloudImage == "" {
+		def.OS.Boot = append(def.OS.Boot, domainBoot{Dev: "cdrom"})
+	}
+	def.OS.Boot = append(def.OS.Boot, domainBoot{Dev: "hd"})
+	def.OS.BootMenu.Enable = "no"
+	if d.SerialConsole != serialConsoleNone {
+		def.OS.BIOS = &domainBIOS{UseSerial: "yes"}
+	}
+
+	devices := &def.Devices
+	if d.ISOVolume != "" || d.ISO != "" {
+		devices.Disks = append(devices.Disks, d.cdrom(d.ISOVolume, d.ISO, "hdc"))
+	}
+	if d.SeedVolume != "" || d.SeedISO != "" {
+		devices.Disks = append(devices.Disks, d.cdrom(d.SeedVolume, d.SeedISO, "hdd"))
+	}
+	typ, src := d.diskSource(d.DiskVolume, d.DiskPath)
+	format := diskFormatRaw
+	if d.DiskVolume != "" {
+		format = d.DiskFormat
+	}
+	devices.Disks = append(devices.Disks, domainDisk{
+		Type:   typ,
+		Device: "disk",
+		Driver: &domainDiskDriver{
+			Name:         "qemu",
+			Type:         format,
+			Cache:        d.CacheMode,
+			IO:           d.IOMode,
+			Discard:      d.DiskDiscard,
+			DetectZeroes: d.DiskDetectZeroes,
+		},
+		Source: src,
+		Target: domainDiskTarget{Dev: diskTarget(d.diskBus(), 0), Bus: d.diskBus()},
+	})
+	devices.Disks = append(devices.Disks, d.extraDiskDevices()...)
+	for _, disk := range devices.Disks {
+		if disk.Target.Bus == diskBusSCSI {
+			// The default lsi controller has no driver in most guests
+			devices.Controllers = append(devices.Controllers, domainController{Type: "scsi", Index: 0, Model: "virtio-scsi"})
+			break
+		}
+	}
+
+	devices.Graphics = []domainGraphics{{
+		Type:      "vnc",
+		AutoPort:  "yes",
+		WebSocket: "-1",
+		Listen:    "127.0.0.1",
+		Listens:   []domainGraphicsListen{{Type: "address", Address: "127.0.0.1"}},
+	}}
+
+	console := domainConsole{Type: "pty", Target: domainCharTarget{Type: "serial", Port: 0}}
+	switch d.SerialConsole {
+	case serialConsoleLog:
+		devices.Serials = []domainSerial{{Type: "pty", Log: &domainCharLog{File: d.ConsoleLog, Append: "on"}}}
+		devices.Consoles = []domainConsole{console}
+	case serialConsoleFile:
+		devices.Serials = []domainSerial{{Type: "file", Source: &domainCharSource{Path: d.ConsoleLog, Append: "on"}}}
+	case serialConsolePty:
+		devices.Serials = []domainSerial{{Type: "pty"}}
+		devices.Consoles = []domainConsole{console}
+	}
+
+	devices.Interfaces = []domainInterface{
+		d.publicInterface(),
+		d.networkInterface(d.PrivateNetwork, d.PrivateMAC),
+	}
+	devices.Interfaces = append(devices.Interfaces, d.extraNetworkInterfaces()...)
+
+	// Lets the agent IP source reach qemu-guest-agent, libvirt picks the
+	// socket path
+	devices.Channels = []domainChannel{{
+		Type:   "unix",
+		Source: domainChannelSource{Mode: "bind"},
+		Target: domainChannelTarget{Type: "virtio", Name: guestAgentChannel},
+	}}
+
+	switch {
+	case d.IgnitionConfig == "":
+	case d.ignitionQemuArg:
+		def.QemuNS = qemuNamespace
+		def.QemuCommandline = &qemuCommandline{Args: []qemuArg{{Value: "-fw_cfg"}, {Value: d.ignitionFwCfg()}}}
+	default:
+		def.SysInfo = &domainSysInfo{
+			Type:    "fwcfg",
+			Entries: []domainSysInfoEntry{{Name: ignitionFwCfgName, File: d.IgnitionConfig}},
+		}
+	}
+	return def
+}
+
+func (d *Driver) networkInterface(network, mac string) domainInterface {
+	iface := domainInterface{
+		Type:   "network",
+		Source: domainInterfaceSource{Network: network},
+		Model:  &domainModel{Type: "virtio"},
+	}
+	if mac != "" {
+		iface.MAC = &domainMAC{Address: mac}
+	}
+	return iface
+}
+
+// The domain definition Create hands to libvirt
+func (d *Driver) domainXML() (string, error) {
+	data, err := xml.MarshalIndent(d.domainDef(), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,184 @@
+package kvm
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func testDomainDriver() *Driver {
+	return &Driver{
+		BaseDriver:     &drivers.BaseDriver{MachineName: "m1"},
+		Memory:         1024,
+		CPU:            2,
+		CacheMode:      "default",
+		IOMode:         "threads",
+		Network:        "default",
+		PrivateNetwork: "docker-machines",
+		PrivateMAC:     "52:54:00:aa:bb:cc",
+		PublicMAC:      "52:54:00:11:22:33",
+		ISO:            "/store/machines/m1/boot2docker.iso",
+		DiskPath:       "/store/machines/m1/m1.img",
+		SerialConsole:  serialConsoleNone,
+	}
+}
+
+func TestDomainXML(t *testing.T) {
+	tests := []struct {
+		name   string
+		golden string
+		setup  func(d *Driver)
+	}{
+		{
+			name:   "defaults",
+			golden: "domain-default.xml",
+			setup:  func(d *Driver) {},
+		},
+		{
+			name:   "virtio bus",
+			golden: "domain-virtio.xml",
+			setup:  func(d *Driver) { d.DiskBus = diskBusVirtio },
+		},
+		{
+			name:   "scsi bus",
+			golden: "domain-scsi.xml",
+			setup:  func(d *Driver) { d.DiskBus = diskBusSCSI },
+		},
+		{
+			name:   "storage pool volumes",
+			golden: "domain-volumes.xml",
+			setup: func(d *Driver) {
+				d.StoragePool = "default"
+				d.ISOVolume = "m1-boot2docker.iso"
+				d.DiskVolume = "m1.qcow2"
+				d.DiskFormat = diskFormatQcow2
+				d.CacheMode = "none"
+				d.IOMode = "native"
+				d.DiskDiscard = "unmap"
+				d.DiskDetectZeroes = "unmap"
+			},
+		},
+		{
+			name:   "serial console log",
+			golden: "domain-serial-log.xml",
+			setup: func(d *Driver) {
+				d.SerialConsole = serialConsoleLog
+				d.ConsoleLog = "/store/machines/m1/console.log"
+			},
+		},
+		{
+			name:   "serial console file",
+			golden: "domain-serial-file.xml",
+			setup: func(d *Driver) {
+				d.SerialConsole = serialConsoleFile
+				d.ConsoleLog = "/store/machines/m1/console.log"
+			},
+		},
+		{
+			name:   "serial console pty",
+			golden: "domain-serial-pty.xml",
+			setup:  func(d *Driver) { d.SerialConsole = serialConsolePty },
+		},
+		{
+			name:   "bridge",
+			golden: "domain-bridge.xml",
+			setup: func(d *Driver) {
+				d.NetworkMode = networkModeBridge
+				d.Bridge = "br0"
+			},
+		},
+		{
+			name:   "open vswitch bridge with vlan trunk",
+			golden: "domain-bridge-ovs.xml",
+			setup: func(d *Driver) {
+				d.NetworkMode = networkModeBridge
+				d.Bridge = "ovsbr0"
+				d.OpenVSwitch = true
+				d.OVSInterfaceID = "09b11c53-8b5c-4eeb-8f00-d84eaa0aaa4f"
+				d.VLANTags = []int{42, 47}
+			},
+		},
+		{
+			name:   "network portgroup",
+			golden: "domain-portgroup.xml",
+			setup: func(d *Driver) {
+				d.Network = "ovs-net"
+				d.Portgroup = "vlan-42"
+			},
+		},
+		{
+			name:   "direct",
+			golden: "domain-direct.xml",
+			setup: func(d *Driver) {
+				d.NetworkMode = networkModeDirect
+				d.HostInterface = "eth0"
+			},
+		},
+		{
+			name:   "ignition",
+			golden: "domain-ignition.xml",
+			setup: func(d *Driver) {
+				d.CloudImage = "fedora-coreos"
+				d.ISO = ""
+				d.IgnitionConfig = "/store/machines/m1/config.ign"
+			},
+		},
+		{
+			name:   "ignition on libvirt before 6.5",
+			golden: "domain-ignition-qemu-arg.xml",
+			setup: func(d *Driver) {
+				d.CloudImage = "fedora-coreos"
+				d.ISO = ""
+				d.IgnitionConfig = "/store/machines/m1,1/config.ign"
+				d.ignitionQemuArg = true
+			},
+		},
+		{
+			name:   "cloud image with extra disks and networks",
+			golden: "domain-extras.xml",
+			setup: func(d *Driver) {
+				d.CloudImage = "ubuntu"
+				d.ISO = ""
+				d.SeedISO = "/store/machines/m1/seed.iso"
+				d.DiskBus = diskBusVirtio
+				d.ExtraDisks = []ExtraDisk{
+					{Name: "data", Format: diskFormatQcow2, Bus: diskBusVirtio, Cache: "default", File: "m1-data.qcow2", Path: "/store/machines/m1/m1-data.qcow2", Target: "vdb"},
+					{Name: "scratch", Format: diskFormatRaw, Bus: diskBusSCSI, Cache: "none", Path: "/dev/sdz", Target: "sda"},
+				}
+				d.ExtraNetworks = []ExtraNetwork{
+					{Network: "storage", Model: "virtio", MAC: "52:54:00:00:00:01"},
+					{Bridge: "br1", Model: "e1000", MAC: "52:54:00:00:00:02"},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := testDomainDriver()
+			tt.setup(d)
+			got, err := d.domainXML()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got += "\n"
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err := ioutil.WriteFile(path, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("domainXML() differs from %s:\n%s", path, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,508 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Name of the final domain definition kept in the machine directory
+const domainXMLFilename = "domain.xml"
+
+// Unlike xml.EscapeText, leaves newlines alone so the output stays readable
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "'", "&apos;", "\"", "&quot;")
+
+// A domain XML patch is either a <domain> fragment merged into the
+// generated definition, or a list of edits addressed with a small subset
+// of XPath, in the spirit of RFC 5261:
+//
+//	<patch>
+//	    <add sel="/domain/devices">
+//	        <filesystem type='mount'>...</filesystem>
+//	    </add>
+//	    <replace sel="/domain/cpu/@mode">host-model</replace>
+//	    <replace sel="/domain/devices/interface[1]/model">
+//	        <model type='e1000'/>
+//	    </replace>
+//	    <remove sel="/domain/devices/graphics"/>
+//	</patch>
+//
+// Selectors are absolute paths of element names or *, each optionally
+// followed by [n] (1-based) and [@attr='value'] predicates, and may end
+// in @attr to address an attribute.
+
+// xmlNode is a minimal DOM. Names keep their prefix as written, e.g.
+// qemu:commandline, so documents round-trip without namespace rewriting
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	// Character data of text nodes, which have no name
+	text string
+}
+
+func rawName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+func parseXMLNode(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		top := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: rawName(t.Name)}
+			for _, a := range t.Attr {
+				n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: rawName(a.Name)}, Value: a.Value})
+			}
+			top.children = append(top.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 1 || top.name != rawName(t.Name) {
+				return nil, fmt.Errorf("unexpected </%s>", rawName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 1 {
+				top.children = append(top.children, &xmlNode{text: string(t)})
+			}
+		}
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("unclosed <%s>", stack[len(stack)-1].name)
+	}
+	elems := root.elements()
+	if len(elems) != 1 {
+		return nil, fmt.Errorf("expected a single root element, found %d", len(elems))
+	}
+	return elems[0], nil
+}
+
+func (n *xmlNode) elements() []*xmlNode {
+	var elems []*xmlNode
+	for _, c := range n.children {
+		if c.name != "" {
+			elems = append(elems, c)
+		}
+	}
+	return elems
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	for i := range n.attrs {
+		if n.attrs[i].Name.Local == name {
+			n.attrs[i].Value = value
+			return
+		}
+	}
+	n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+func (n *xmlNode) removeAttr(name string) {
+	for i := range n.attrs {
+		if n.attrs[i].Name.Local == name {
+			n.attrs = append(n.attrs[:i], n.attrs[i+1:]...)
+			return
+		}
+	}
+}
+
+// Text content of the node, ignoring surrounding whitespace
+func (n *xmlNode) textContent() string {
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.text)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func (n *xmlNode) write(b *bytes.Buffer) {
+	if n.name == "" {
+		b.WriteString(xmlEscaper.Replace(n.text))
+		return
+	}
+	b.WriteString("<" + n.name)
+	for _, a := range n.attrs {
+		b.WriteString(" " + a.Name.Local + "='" + xmlEscaper.Replace(a.Value) + "'")
+	}
+	if len(n.children) == 0 {
+		b.WriteString("/>")
+		return
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		c.write(b)
+	}
+	b.WriteString("</" + n.name + ">")
+}
+
+// Deep copy of the node, so the same patch content can be inserted in
+// several places without the copies sharing children
+func (n *xmlNode) clone() *xmlNode {
+	c := &xmlNode{name: n.name, text: n.text}
+	c.attrs = append(c.attrs, n.attrs...)
+	for _, child := range n.children {
+		c.children = append(c.children, child.clone())
+	}
+	return c
+}
+
+// Copies of the elements of the node
+func (n *xmlNode) cloneElements() []*xmlNode {
+	var elems []*xmlNode
+	for _, e := range n.elements() {
+		elems = append(elems, e.clone())
+	}
+	return elems
+}
+
+func (n *xmlNode) String() string {
+	var b bytes.Buffer
+	n.write(&b)
+	return b.String()
+}
+
+type selectorStep struct {
+	name  string
+	index int
+	attrs map[string]string
+}
+
+type selector struct {
+	steps []selectorStep
+	// Attribute addressed by the selector, if any
+	attr string
+}
+
+func parseSelector(sel string) (*selector, error) {
+	if !strings.HasPrefix(sel, "/") {
+		return nil, fmt.Errorf("selector %q has to be an absolute path", sel)
+	}
+	s := &selector{}
+	parts := strings.Split(sel[1:], "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, "@") && i == len(parts)-1 && i > 0 {
+			s.attr = part[1:]
+			break
+		}
+		step := selectorStep{attrs: map[string]string{}}
+		if open := strings.Index(part, "["); open >= 0 {
+			step.name = part[:open]
+			preds := part[open:]
+			for preds != "" {
+				end := strings.Index(preds, "]")
+				if !strings.HasPrefix(preds, "[") || end < 0 {
+					return nil, fmt.Errorf("malformed predicate in selector %q", sel)
+				}
+				pred := preds[1:end]
+				preds = preds[end+1:]
+				if strings.HasPrefix(pred, "@") {
+					kv := strings.SplitN(pred[1:], "=", 2)
+					if len(kv) != 2 || len(kv[1]) < 2 || kv[1][0] != kv[1][len(kv[1])-1] || (kv[1][0] != '\'' && kv[1][0] != '"') {
+						return nil, fmt.Errorf("malformed attribute predicate [%s] in selector %q", pred, sel)
+					}
+					step.attrs[kv[0]] = kv[1][1 : len(kv[1])-1]
+					continue
+				}
+				index, err := strconv.Atoi(pred)
+				if err != nil || index < 1 {
+					return nil, fmt.Errorf("malformed predicate [%s] in selector %q", pred, sel)
+				}
+				step.index = index
+			}
+		} else {
+			step.name = part
+		}
+		if step.name == "" {
+			return nil, fmt.Errorf("empty step in selector %q", sel)
+		}
+		s.steps = append(s.steps, step)
+	}
+	return s, nil
+}
+
+func (step selectorStep) matches(n *xmlNode) bool {
+	if step.name != "*" && step.name != n.name {
+		return false
+	}
+	for k, v := range step.attrs {
+		if got, ok := n.attr(k); !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// A matched element together with its parent, so it can be replaced or
+// removed
+type xmlMatch struct {
+	parent, node *xmlNode
+}
+
+func (s *selector) find(root *xmlNode) []xmlMatch {
+	if !s.steps[0].matches(root) || s.steps[0].index > 1 {
+		return nil
+	}
+	matches := []xmlMatch{{node: root}}
+	for _, step := range s.steps[1:] {
+		var next []xmlMatch
+		for _, m := range matches {
+			count := 0
+			for _, c := range m.node.elements() {
+				if !step.matches(c) {
+					continue
+				}
+				count++
+				if step.index == 0 || step.index == count {
+					next = append(next, xmlMatch{parent: m.node, node: c})
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+func (n *xmlNode) childIndex(child *xmlNode) int {
+	for i, c := range n.children {
+		if c == child {
+			return i
+		}
+	}
+	return -1
+}
+
+func (n *xmlNode) insert(i int, nodes ...*xmlNode) {
+	children := append([]*xmlNode{}, n.children[:i]...)
+	children = append(children, nodes...)
+	n.children = append(children, n.children[i:]...)
+}
+
+// Apply one <add>, <replace> or <remove> operation to the document
+func applyPatchOp(doc, op *xmlNode) error {
+	selAttr, ok := op.attr("sel")
+	if !ok {
+		return fmt.Errorf("<%s> without a sel attribute", op.name)
+	}
+	sel, err := parseSelector(selAttr)
+	if err != nil {
+		return err
+	}
+	matches := sel.find(doc)
+	if len(matches) == 0 {
+		return fmt.Errorf("selector %q matches nothing", selAttr)
+	}
+	for _, m := range matches {
+		switch {
+		case op.name == "add" && sel.attr != "":
+			m.node.setAttr(sel.attr, op.textContent())
+		case op.name == "add":
+			pos, _ := op.attr("pos")
+			switch pos {
+			case "", "append":
+				m.node.children = append(m.node.children, op.cloneElements()...)
+			case "prepend":
+				m.node.insert(0, op.cloneElements()...)
+			case "before", "after":
+				if m.parent == nil {
+					return fmt.Errorf("can't add %s the root element", pos)
+				}
+				i := m.parent.childIndex(m.node)
+				if pos == "after" {
+					i++
+				}
+				m.parent.insert(i, op.cloneElements()...)
+			default:
+				return fmt.Errorf("unsupported position %q, expected append, prepend, before or after", pos)
+			}
+		case op.name == "replace" && sel.attr != "":
+			if _, ok := m.node.attr(sel.attr); !ok {
+				return fmt.Errorf("selector %q matches no attribute", selAttr)
+			}
+			m.node.setAttr(sel.attr, op.textContent())
+		case op.name == "replace":
+			if m.parent == nil {
+				return fmt.Errorf("can't replace the root element")
+			}
+			i := m.parent.childIndex(m.node)
+			m.parent.children = append(m.parent.children[:i], m.parent.children[i+1:]...)
+			m.parent.insert(i, op.cloneElements()...)
+		case op.name == "remove" && sel.attr != "":
+			m.node.removeAttr(sel.attr)
+		case op.name == "remove":
+			if m.parent == nil {
+				return fmt.Errorf("can't remove the root element")
+			}
+			i := m.parent.childIndex(m.node)
+			m.parent.children = append(m.parent.children[:i], m.parent.children[i+1:]...)
+		default:
+			return fmt.Errorf("unsupported patch operation <%s>, expected add, replace or remove", op.name)
+		}
+	}
+	return nil
+}
+
+// Merge a <domain> fragment into the document. Attributes and text of the
+// fragment win. Elements pair up by name and position: the n-th <boot> of
+// the fragment is merged into the n-th <boot> of the document, or added if
+// the document has fewer. Elements under devices are always added. Use an
+// <add> patch to add an element next to existing ones of the same name
+func mergeXMLNode(dst, src *xmlNode) {
+	for _, a := range src.attrs {
+		dst.setAttr(a.Name.Local, a.Value)
+	}
+	if len(src.elements()) == 0 && src.textContent() != "" {
+		dst.children = []*xmlNode{{text: src.textContent()}}
+		return
+	}
+	seen := map[string]int{}
+	for _, child := range src.elements() {
+		var existing *xmlNode
+		if dst.name != "devices" {
+			n := seen[child.name]
+			seen[child.name]++
+			for _, c := range dst.elements() {
+				if c.name != child.name {
+					continue
+				}
+				if n == 0 {
+					existing = c
+					break
+				}
+				n--
+			}
+		}
+		if existing == nil {
+			dst.children = append(dst.children, child.clone())
+			continue
+		}
+		mergeXMLNode(existing, child)
+	}
+}
+
+// The driver finds the domain by its name, so patches must leave it and
+// the UUID alone
+var protectedDomainElements = []string{"name", "uuid"}
+
+func checkProtectedElements(elems []*xmlNode) error {
+	for _, e := range elems {
+		if oneOf(e.name, protectedDomainElements) {
+			return fmt.Errorf("the domain %s can't be patched", e.name)
+		}
+	}
+	return nil
+}
+
+// Check the selector of an operation, and that it can't change the name
+// or UUID of the domain
+func checkPatchOp(op *xmlNode) error {
+	selAttr, _ := op.attr("sel")
+	sel, err := parseSelector(selAttr)
+	if err != nil {
+		return err
+	}
+	if len(sel.steps) >= 2 {
+		step := sel.steps[1].name
+		if step == "*" {
+			return fmt.Errorf("selector %q may match the domain name or uuid, which can't be patched", selAttr)
+		}
+		if oneOf(step, protectedDomainElements) {
+			return fmt.Errorf("the domain %s can't be patched", step)
+		}
+	}
+	// Elements inserted directly under <domain>
+	if len(sel.steps) <= 2 {
+		return checkProtectedElements(op.elements())
+	}
+	return nil
+}
+
+// Name and UUID elements of the document, to make sure patching left
+// them as they were
+func domainIdentity(doc *xmlNode) string {
+	var b strings.Builder
+	for _, e := range doc.elements() {
+		if oneOf(e.name, protectedDomainElements) {
+			b.WriteString(e.String())
+		}
+	}
+	return b.String()
+}
+
+// Read and check the patch file
+func loadDomainPatch(path string) (*xmlNode, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := parseXMLNode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("malformed domain XML patch %s: %s", path, err)
+	}
+	switch patch.name {
+	case "domain":
+		if err := checkProtectedElements(patch.elements()); err != nil {
+			return nil, fmt.Errorf("domain XML patch %s: %s", path, err)
+		}
+	case "patch":
+		for _, op := range patch.elements() {
+			if err := checkPatchOp(op); err != nil {
+				return nil, fmt.Errorf("domain XML patch %s: %s", path, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("domain XML patch %s has to be a <domain> fragment or a <patch>, not <%s>", path, patch.name)
+	}
+	return patch, nil
+}
+
+// Apply the patch file at path to the domain definition
+func patchDomainXML(domain, path string) (string, error) {
+	patch, err := loadDomainPatch(path)
+	if err != nil {
+		return "", err
+	}
+	doc, err := parseXMLNode(strings.NewReader(domain))
+	if err != nil {
+		return "", err
+	}
+	identity := domainIdentity(doc)
+	if patch.name == "domain" {
+		mergeXMLNode(doc, patch)
+	} else {
+		for _, op := range patch.elements() {
+			if err := applyPatchOp(doc, op); err != nil {
+				return "", fmt.Errorf("domain XML patch %s: %s", path, err)
+			}
+		}
+	}
+	if domainIdentity(doc) != identity {
+		return "", fmt.Errorf("domain XML patch %s changes the domain name or uuid", path)
+	}
+	return doc.String(), nil
+}
@@ -0,0 +1,238 @@
+package kvm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPatchDomain = `<domain type='kvm'><name>m1</name><os><type>hvm</type><boot dev='cdrom'/><boot dev='hd'/></os>` +
+	`<devices><disk device='cdrom'><target dev='hdc'/></disk><disk device='disk'><target dev='hda'/></disk>` +
+	`<interface type='network'><model type='virtio'/></interface><interface type='network'><model type='virtio'/></interface>` +
+	`<graphics type='vnc'/></devices></domain>`
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		sel     string
+		steps   int
+		attr    string
+		wantErr bool
+	}{
+		{sel: "/domain/devices", steps: 2},
+		{sel: "/domain/cpu/@mode", steps: 2, attr: "mode"},
+		{sel: "/domain/devices/interface[2]/model", steps: 4},
+		{sel: "/domain/devices/disk[@device='cdrom'][1]", steps: 3},
+		{sel: "/domain/*/disk", steps: 3},
+		{sel: "domain/devices", wantErr: true},
+		{sel: "/domain//disk", wantErr: true},
+		{sel: "/domain/disk[0]", wantErr: true},
+		{sel: "/domain/disk[x]", wantErr: true},
+		{sel: "/domain/disk[@device=cdrom]", wantErr: true},
+		{sel: "/domain/disk[1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sel, func(t *testing.T) {
+			s, err := parseSelector(tt.sel)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(s.steps) != tt.steps || s.attr != tt.attr {
+				t.Errorf("parseSelector() = %d steps, attr %q, want %d steps, attr %q", len(s.steps), s.attr, tt.steps, tt.attr)
+			}
+		})
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		want    []string
+		notWant []string
+		wantErr bool
+	}{
+		{
+			name:  "replace attribute",
+			patch: `<patch><replace sel="/domain/@type">qemu</replace></patch>`,
+			want:  []string{"<domain type='qemu'>"},
+		},
+		{
+			name:    "replace missing attribute",
+			patch:   `<patch><replace sel="/domain/@foo">bar</replace></patch>`,
+			wantErr: true,
+		},
+		{
+			name:  "add attribute",
+			patch: `<patch><add sel="/domain/os/boot[2]/@order">1</add></patch>`,
+			want:  []string{"<boot dev='hd' order='1'/>"},
+		},
+		{
+			name:  "replace element",
+			patch: `<patch><replace sel="/domain/devices/interface[2]/model"><model type='e1000'/></replace></patch>`,
+			want:  []string{"<model type='virtio'/></interface><interface type='network'><model type='e1000'/>"},
+		},
+		{
+			name:    "remove element",
+			patch:   `<patch><remove sel="/domain/devices/graphics"/></patch>`,
+			notWant: []string{"graphics"},
+		},
+		{
+			name:  "add before",
+			patch: `<patch><add sel="/domain/devices/disk[@device='disk']" pos="before"><controller type='usb'/></add></patch>`,
+			want:  []string{"</disk><controller type='usb'/><disk device='disk'>"},
+		},
+		{
+			name:  "add prepend",
+			patch: `<patch><add sel="/domain/os" pos="prepend"><loader/></add></patch>`,
+			want:  []string{"<os><loader/><type>"},
+		},
+		{
+			name:    "add to root sibling",
+			patch:   `<patch><add sel="/domain" pos="after"><foo/></add></patch>`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown position",
+			patch:   `<patch><add sel="/domain" pos="middle"><foo/></add></patch>`,
+			wantErr: true,
+		},
+		{
+			name:    "no match",
+			patch:   `<patch><remove sel="/domain/devices/rng"/></patch>`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown operation",
+			patch:   `<patch><move sel="/domain/devices"/></patch>`,
+			wantErr: true,
+		},
+		{
+			name:  "merge fragment",
+			patch: `<domain><cpu mode='host-model'/><devices><rng model='virtio'/></devices></domain>`,
+			want:  []string{"<graphics type='vnc'/><rng model='virtio'/></devices><cpu mode='host-model'/>"},
+		},
+		{
+			name:  "merge pairs elements by position",
+			patch: `<domain><os><boot dev='hd'/><boot dev='network'/><boot dev='cdrom'/></os></domain>`,
+			want:  []string{"<boot dev='hd'/><boot dev='network'/><boot dev='cdrom'/></os>"},
+		},
+		{
+			name:  "merge text",
+			patch: `<domain><os><type>linux</type></os></domain>`,
+			want:  []string{"<os><type>linux</type>"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := parseXMLNode(strings.NewReader(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc, err := parseXMLNode(strings.NewReader(testPatchDomain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if patch.name == "domain" {
+				mergeXMLNode(doc, patch)
+			} else {
+				for _, op := range patch.elements() {
+					if err = applyPatchOp(doc, op); err != nil {
+						break
+					}
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("apply error = %v, wantErr %v", err, tt.wantErr)
+			}
+			got := doc.String()
+			for _, w := range tt.want {
+				if !strings.Contains(got, w) {
+					t.Errorf("result lacks %s:\n%s", w, got)
+				}
+			}
+			for _, w := range tt.notWant {
+				if strings.Contains(got, w) {
+					t.Errorf("result has %s:\n%s", w, got)
+				}
+			}
+		})
+	}
+}
+
+// Content added under several matches must not be shared, or a later
+// edit of one copy shows up in all of them
+func TestApplyPatchMultipleMatches(t *testing.T) {
+	patch := `<patch>` +
+		`<add sel="/domain/devices/interface"><driver queues='2'/></add>` +
+		`<replace sel="/domain/devices/interface[1]/driver/@queues">4</replace>` +
+		`</patch>`
+	p, err := parseXMLNode(strings.NewReader(patch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := parseXMLNode(strings.NewReader(testPatchDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range p.elements() {
+		if err := applyPatchOp(doc, op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := doc.String()
+	want := "<model type='virtio'/><driver queues='4'/></interface><interface type='network'><model type='virtio'/><driver queues='2'/></interface>"
+	if !strings.Contains(got, want) {
+		t.Errorf("result lacks %s:\n%s", want, got)
+	}
+}
+
+// The driver looks the domain up by name, patches must not change it
+func TestLoadDomainPatchProtected(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		wantErr bool
+	}{
+		{name: "fragment name", patch: `<domain><name>other</name></domain>`, wantErr: true},
+		{name: "fragment uuid", patch: `<domain><uuid>c7a5fdbd-edaf-9455-926a-d65c16db1809</uuid></domain>`, wantErr: true},
+		{name: "replace name", patch: `<patch><replace sel="/domain/name"><name>other</name></replace></patch>`, wantErr: true},
+		{name: "remove uuid", patch: `<patch><remove sel="/domain/uuid"/></patch>`, wantErr: true},
+		{name: "name attribute", patch: `<patch><add sel="/domain/name/@foo">bar</add></patch>`, wantErr: true},
+		{name: "wildcard", patch: `<patch><remove sel="/domain/*"/></patch>`, wantErr: true},
+		{name: "add name", patch: `<patch><add sel="/domain"><name>other</name></add></patch>`, wantErr: true},
+		{name: "add uuid next to os", patch: `<patch><add sel="/domain/os" pos="after"><uuid>x</uuid></add></patch>`, wantErr: true},
+		{name: "replace with name", patch: `<patch><replace sel="/domain/cpu"><name>other</name></replace></patch>`, wantErr: true},
+		{name: "fragment", patch: `<domain><cpu mode='host-model'/></domain>`},
+		{name: "devices", patch: `<patch><remove sel="/domain/devices/graphics"/></patch>`},
+		{name: "wildcard below devices", patch: `<patch><remove sel="/domain/devices/*[@type='vnc']"/></patch>`},
+	}
+	tmp, err := ioutil.TempDir("", "kvm-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmp, fmt.Sprintf("patch%d.xml", i))
+			if err := ioutil.WriteFile(path, []byte(tt.patch), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadDomainPatch(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadDomainPatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, err := patchDomainXML(testPatchDomain, path); err != nil {
+				t.Errorf("patchDomainXML() error = %v", err)
+			}
+		})
+	}
+}
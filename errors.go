@@ -0,0 +1,60 @@
+package kvm
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rancher/machine/libmachine/state"
+)
+
+// Lines of the serial console included in boot failures
+const consoleTailLines = 20
+
+// StartTimeoutError is returned by Start when the VM doesn't get an IP
+// address, or doesn't answer on its SSH port, within --kvm-timeout
+type StartTimeoutError struct {
+	MachineName string
+	Timeout     time.Duration
+	State       state.State
+	MAC         string
+	// Address the VM got, if it was SSH that never came up
+	IP string
+	// IP sources that were queried, in order
+	Sources []string
+	// Last lines of the guest serial console, if it is logged
+	ConsoleTail []string
+}
+
+func (e *StartTimeoutError) Error() string {
+	var b strings.Builder
+	if e.IP == "" {
+		fmt.Fprintf(&b, "VM %s did not get an IP address within %s (state: %s, MAC: %s, IP sources tried: %s)",
+			e.MachineName, e.Timeout, e.State, e.MAC, strings.Join(e.Sources, ", "))
+	} else {
+		fmt.Fprintf(&b, "VM %s did not accept SSH connections on %s within %s (state: %s, MAC: %s, IP source: %s)",
+			e.MachineName, e.IP, e.Timeout, e.State, e.MAC, strings.Join(e.Sources, ", "))
+	}
+	if len(e.ConsoleTail) > 0 {
+		b.WriteString("\nLast lines of the serial console:\n    ")
+		b.WriteString(strings.Join(e.ConsoleTail, "\n    "))
+	}
+	return b.String()
+}
+
+func (d *Driver) startTimeoutError(ip string) *StartTimeoutError {
+	e := &StartTimeoutError{
+		MachineName: d.MachineName,
+		Timeout:     d.timeout(),
+		IP:          ip,
+	}
+	e.ConsoleTail, _ = d.ConsoleTail(consoleTailLines)
+	e.State, _ = d.GetState()
+	e.MAC, _ = d.getMAC()
+	if ip != "" {
+		e.Sources = []string{d.IPAddressSource}
+	} else {
+		e.Sources, _ = d.ipSourceOrder()
+	}
+	return e
+}
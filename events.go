@@ -0,0 +1,169 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/state"
+)
+
+const (
+	defaultTimeout = 300
+	// Earlier releases slept for Timeout seconds and then polled for the
+	// address up to this many times, a second apart
+	legacyPollSeconds = 350
+
+	eventLoopMinBackoff = 10 * time.Millisecond
+	eventLoopMaxBackoff = 5 * time.Second
+
+	pollInterval   = time.Second
+	sshDialTimeout = 2 * time.Second
+)
+
+var (
+	eventLoopOnce sync.Once
+	eventLoopErr  error
+)
+
+// libvirt only delivers events on connections opened after the default
+// event loop implementation was registered, so this has to run before
+// the first connection is made
+func startEventLoop() error {
+	eventLoopOnce.Do(func() {
+		if eventLoopErr = libvirt.EventRegisterDefaultImpl(); eventLoopErr != nil {
+			return
+		}
+		go func() {
+			backoff := eventLoopMinBackoff
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					log.Debugf("libvirt event loop: %s", err)
+					time.Sleep(backoff)
+					if backoff < eventLoopMaxBackoff {
+						backoff *= 2
+					}
+					continue
+				}
+				backoff = eventLoopMinBackoff
+			}
+		}()
+	})
+	return eventLoopErr
+}
+
+// Upper bound for waiting on the VM to boot or shut down. Machines saved
+// by earlier releases only have Timeout, the initial sleep, and get the
+// total time those releases allowed
+func (d *Driver) timeout() time.Duration {
+	switch {
+	case d.BootTimeout > 0:
+		return time.Duration(d.BootTimeout) * time.Second
+	case d.Timeout > 0:
+		return time.Duration(d.Timeout+legacyPollSeconds) * time.Second
+	}
+	return defaultTimeout * time.Second
+}
+
+// Subscribe to lifecycle events of the machine's domain. When events are
+// unavailable the returned channel is nil and callers fall back to polling
+func (d *Driver) watchLifecycle() (<-chan libvirt.DomainEventType, func()) {
+	conn, err := d.getConn()
+	// A nil domain would subscribe to events of every domain
+	if err != nil || eventLoopErr != nil || d.VM == nil {
+		return nil, func() {}
+	}
+	events := make(chan libvirt.DomainEventType, 16)
+	id, err := conn.DomainEventLifecycleRegister(d.VM, func(c *libvirt.Connect, dom *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		log.Debugf("VM %s lifecycle event: %s", d.MachineName, event)
+		select {
+		case events <- event.Event:
+		default:
+		}
+	})
+	if err != nil {
+		log.Debugf("Unable to register for lifecycle events, polling instead: %s", err)
+		return nil, func() {}
+	}
+	return events, func() {
+		if err := conn.DomainEventDeregister(id); err != nil {
+			log.Debugf("Failed to deregister lifecycle events: %s", err)
+		}
+	}
+}
+
+// Poll until the VM has an address and answers on its SSH port, failing
+// with a StartTimeoutError once the timeout expires. Lifecycle events only
+// end the wait early when the VM stops or crashes
+func (d *Driver) waitForBoot(events <-chan libvirt.DomainEventType) error {
+	timer := time.NewTimer(d.timeout())
+	defer timer.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		ip, _ := d.GetIP()
+		if ip != "" && d.sshReachable(ip) {
+			return nil
+		}
+		if ip == "" {
+			log.Debugf("Waiting for the VM to get an IP address...")
+		} else {
+			log.Debugf("Waiting for SSH on %s...", ip)
+		}
+		select {
+		case event := <-events:
+			if event == libvirt.DOMAIN_EVENT_STOPPED || event == libvirt.DOMAIN_EVENT_CRASHED {
+				return fmt.Errorf("VM %s stopped while booting (%s)", d.MachineName, event)
+			}
+		case <-ticker.C:
+		case <-timer.C:
+			return d.startTimeoutError(ip)
+		}
+	}
+}
+
+func (d *Driver) sshReachable(ip string) bool {
+	port, err := d.GetSSHPort()
+	if err != nil {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), sshDialTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Wait for the stopped event, checking the state as well so a shutdown
+// that completed before we subscribed isn't missed
+func (d *Driver) waitForShutdown(events <-chan libvirt.DomainEventType) error {
+	timer := time.NewTimer(d.timeout())
+	defer timer.Stop()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		s, _ := d.GetState()
+		log.Debugf("VM state: %s", s)
+		if s == state.Stopped {
+			return nil
+		}
+		select {
+		case event := <-events:
+			if event == libvirt.DOMAIN_EVENT_STOPPED {
+				return nil
+			}
+		case <-ticker.C:
+		case <-timer.C:
+			return errors.New("VM Failed to gracefully shutdown, try the kill command")
+		}
+	}
+}
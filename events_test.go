@@ -0,0 +1,28 @@
+package kvm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		bootTimeout int
+		timeout     int
+		want        time.Duration
+	}{
+		{name: "default", want: 300 * time.Second},
+		{name: "configured", bootTimeout: 120, want: 120 * time.Second},
+		{name: "legacy initial delay", timeout: 90, want: 440 * time.Second},
+		{name: "configured wins over legacy", bootTimeout: 60, timeout: 90, want: 60 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{BootTimeout: tt.bootTimeout, Timeout: tt.timeout}
+			if got := d.timeout(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// IDE has four slots: the machine disk takes hda and the boot ISO and
+// cloud-init seed hdc and hdd
+var ideCdromTargets = []string{"hdc", "hdd"}
+
+// Names end up in file and volume names
+var extraDiskNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ExtraDisk is a data disk attached to the machine besides the disk it
+// boots from
+type ExtraDisk struct {
+	Name string
+	// Size in MB, for disks the driver creates
+	Size   int
+	Format string
+	Bus    string
+	Cache  string
+	// Existing file or block device on the libvirtd host to attach as is.
+	// The driver never creates or removes it
+	Path string
+	// Keep the disk when the machine is removed and reuse it when a
+	// machine of the same name is created again
+	Keep bool
+
+	// Volume in the storage pool, or file in the artifact layout, the
+	// driver created for the disk
+	Volume string
+	File   string
+	Target string
+}
+
+// Parse a --kvm-extra-disk value: comma separated key=value pairs out of
+// name, size, format, bus, cache, path and keep
+func parseExtraDisk(spec string) (ExtraDisk, error) {
+	var disk ExtraDisk
+	for _, opt := range strings.Split(spec, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return disk, fmt.Errorf("extra disk %q: expected key=value, got %q", spec, opt)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "name":
+			if !extraDiskNamePattern.MatchString(value) {
+				return disk, fmt.Errorf("extra disk %q: invalid name %q, use letters, digits, _ and -", spec, value)
+			}
+			disk.Name = value
+		case "size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 {
+				return disk, fmt.Errorf("extra disk %q: invalid size %q, expected MB", spec, value)
+			}
+			disk.Size = size
+		case "format":
+			disk.Format = value
+		case "bus":
+			disk.Bus = value
+		case "cache":
+			disk.Cache = value
+		case "path":
+			disk.Path = value
+		case "keep":
+			keep, err := strconv.ParseBool(value)
+			if err != nil {
+				return disk, fmt.Errorf("extra disk %q: invalid keep %q", spec, value)
+			}
+			disk.Keep = keep
+		default:
+			return disk, fmt.Errorf("extra disk %q: unknown option %q", spec, key)
+		}
+	}
+	return disk, nil
+}
+
+// Fill in the defaults of the extra disks and the names of what the
+// driver creates for them. Called once the storage pool is known
+func (d *Driver) setupExtraDisks(specs []string) error {
+	d.ExtraDisks = nil
+	names := map[string]bool{}
+	for i, spec := range specs {
+		disk, err := parseExtraDisk(spec)
+		if err != nil {
+			return err
+		}
+		if disk.Name == "" {
+			disk.Name = fmt.Sprintf("disk%d", i+1)
+		}
+		// Two disks of the same name would share a file or volume
+		if names[disk.Name] {
+			return fmt.Errorf("extra disk name %s is used twice", disk.Name)
+		}
+		names[disk.Name] = true
+		if disk.Format == "" {
+			disk.Format = diskFormatRaw
+		}
+		if disk.Bus == "" {
+			disk.Bus = d.extraDiskBus()
+		}
+		if disk.Cache == "" {
+			disk.Cache = d.CacheMode
+		}
+		if disk.Path == "" {
+			ext := "img"
+			if disk.Format == diskFormatQcow2 {
+				ext = diskFormatQcow2
+			}
+			filename := fmt.Sprintf("%s-%s.%s", d.MachineName, disk.Name, ext)
+			if d.StoragePool != "" {
+				disk.Volume = filename
+			} else {
+				disk.File = filename
+			}
+		}
+		d.ExtraDisks = append(d.ExtraDisks, disk)
+	}
+	return d.assignDiskTargets()
+}
+
+// Extra disks go on the bus of the machine disk, except for IDE, which
+// only has a single slot left for them
+func (d *Driver) extraDiskBus() string {
+	if bus := d.diskBus(); bus != diskBusIDE {
+		return bus
+	}
+	return diskBusVirtio
+}
+
+// Give each extra disk the next free target on its bus
+func (d *Driver) assignDiskTargets() error {
+	used := map[string]bool{diskTarget(d.diskBus(), 0): true}
+	for _, t := range ideCdromTargets {
+		used[t] = true
+	}
+	for i := range d.ExtraDisks {
+		disk := &d.ExtraDisks[i]
+		limit := 26
+		if disk.Bus == diskBusIDE {
+			limit = 4
+		}
+		disk.Target = ""
+		for n := 0; n < limit; n++ {
+			if t := diskTarget(disk.Bus, n); !used[t] {
+				disk.Target = t
+				used[t] = true
+				break
+			}
+		}
+		if disk.Target == "" {
+			if disk.Bus == diskBusIDE {
+				return fmt.Errorf("no free ide slot for extra disk %s, IDE only has room for one extra disk, use bus=virtio or bus=scsi", disk.Name)
+			}
+			return fmt.Errorf("no free %s slot for extra disk %s", disk.Bus, disk.Name)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) validateExtraDisks() error {
+	names := map[string]bool{}
+	for _, disk := range d.ExtraDisks {
+		if names[disk.Name] {
+			return fmt.Errorf("extra disk name %s is used twice", disk.Name)
+		}
+		names[disk.Name] = true
+		if disk.Format != diskFormatRaw && disk.Format != diskFormatQcow2 {
+			return fmt.Errorf("extra disk %s: unsupported format %q, expected %s or %s", disk.Name, disk.Format, diskFormatRaw, diskFormatQcow2)
+		}
+		if !oneOf(disk.Bus, diskBuses) {
+			return fmt.Errorf("extra disk %s: unsupported bus %q, expected one of %v", disk.Name, disk.Bus, diskBuses)
+		}
+		if !oneOf(disk.Cache, cacheModes) {
+			return fmt.Errorf("extra disk %s: unsupported cache mode %q, expected one of %v", disk.Name, disk.Cache, cacheModes)
+		}
+		if d.IOMode == "native" && disk.Cache != "none" && disk.Cache != "directsync" {
+			return fmt.Errorf("extra disk %s: disk IO mode native needs cache mode none or directsync, not %s", disk.Name, disk.Cache)
+		}
+		if disk.Path != "" {
+			continue
+		}
+		if disk.Size == 0 {
+			return fmt.Errorf("extra disk %s needs a size or an existing path", disk.Name)
+		}
+		if disk.Format == diskFormatQcow2 && disk.Volume == "" {
+			return fmt.Errorf("extra disk %s: format %s requires a storage pool, use --kvm-storage-pool", disk.Name, disk.Format)
+		}
+		// docker-machine deletes the machine directory on rm
+		if disk.Keep && disk.Volume == "" {
+			return fmt.Errorf("extra disk %s can only be kept in a storage pool, use --kvm-storage-pool", disk.Name)
+		}
+	}
+	return nil
+}
+
+// Create the volumes and files of the extra disks, reusing kept volumes
+// left behind by an earlier machine of the same name
+func (d *Driver) createExtraDisks(layout artifactLayout) error {
+	for i := range d.ExtraDisks {
+		disk := &d.ExtraDisks[i]
+		switch {
+		case disk.Volume != "":
+			if err := d.createExtraDiskVolume(disk); err != nil {
+				return err
+			}
+		case disk.File != "":
+			path := layout.local(disk.File)
+			log.Infof("Creating extra disk %s...", disk.Name)
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			f.Close()
+			if err := os.Truncate(path, int64(disk.Size)*1000000); err != nil {
+				return err
+			}
+			if err := layout.setPermissions(disk.File); err != nil {
+				return err
+			}
+			disk.Path = layout.host(disk.File)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) createExtraDiskVolume(disk *ExtraDisk) error {
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	if vol, err := pool.LookupStorageVolByName(disk.Volume); err == nil {
+		vol.Free()
+		if !disk.Keep {
+			return fmt.Errorf("volume %s already exists in storage pool %s", disk.Volume, d.StoragePool)
+		}
+		log.Infof("Reusing kept volume %s for extra disk %s", disk.Volume, disk.Name)
+		return nil
+	} else if !isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return err
+	}
+	log.Infof("Creating extra disk %s in storage pool %s...", disk.Name, d.StoragePool)
+	vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, disk.Volume, uint64(disk.Size)*1000000, disk.Format), 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", disk.Volume, err)
+		return err
+	}
+	return vol.Free()
+}
+
+// Remove the volumes of the extra disks the driver created and wasn't
+// asked to keep. Files in the artifact layout go away with it
+func (d *Driver) removeExtraDisks() error {
+	for _, disk := range d.ExtraDisks {
+		if disk.Volume == "" {
+			continue
+		}
+		if disk.Keep {
+			log.Infof("Keeping volume %s of extra disk %s", disk.Volume, disk.Name)
+			continue
+		}
+		if err := d.removeVolume(disk.Volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) extraDiskDevices() []domainDisk {
+	var disks []domainDisk
+	for _, disk := range d.ExtraDisks {
+		typ, src := d.diskSource(disk.Volume, disk.Path)
+		if disk.Volume == "" && strings.HasPrefix(disk.Path, "/dev/") {
+			typ, src = "block", domainDiskSource{Dev: disk.Path}
+		}
+		disks = append(disks, domainDisk{
+			Type:   typ,
+			Device: "disk",
+			Driver: &domainDiskDriver{Name: "qemu", Type: disk.Format, Cache: disk.Cache, IO: d.IOMode},
+			Source: src,
+			Target: domainDiskTarget{Dev: disk.Target, Bus: disk.Bus},
+		})
+	}
+	return disks
+}
@@ -0,0 +1,207 @@
+package kvm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+func TestParseExtraDisk(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ExtraDisk
+		wantErr bool
+	}{
+		{
+			spec: "name=data,size=1000,format=qcow2,bus=scsi,cache=none,keep=true",
+			want: ExtraDisk{Name: "data", Size: 1000, Format: "qcow2", Bus: "scsi", Cache: "none", Keep: true},
+		},
+		{
+			spec: " path = /dev/sdb ",
+			want: ExtraDisk{Path: "/dev/sdb"},
+		},
+		{spec: "size=0", wantErr: true},
+		{spec: "size=10G", wantErr: true},
+		{spec: "keep=maybe", wantErr: true},
+		{spec: "size", wantErr: true},
+		{spec: "label=data", wantErr: true},
+		{spec: "name=../../x,size=1", wantErr: true},
+		{spec: "name=a/b,size=1", wantErr: true},
+		{spec: "name=a.b,size=1", wantErr: true},
+		{spec: "name=,size=1", wantErr: true},
+		{spec: "name=data_2-b,size=1", want: ExtraDisk{Name: "data_2-b", Size: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseExtraDisk(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtraDisk() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExtraDisk() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupExtraDisks(t *testing.T) {
+	tests := []struct {
+		name        string
+		diskBus     string
+		storagePool string
+		specs       []string
+		buses       []string
+		targets     []string
+		volumes     []string
+		files       []string
+		wantErr     bool
+	}{
+		{
+			name:    "ide machine disk defaults to virtio",
+			specs:   []string{"size=100", "size=100"},
+			buses:   []string{"virtio", "virtio"},
+			targets: []string{"vda", "vdb"},
+			volumes: []string{"", ""},
+			files:   []string{"m1-disk1.img", "m1-disk2.img"},
+		},
+		{
+			name:        "machine disk bus",
+			diskBus:     diskBusVirtio,
+			storagePool: "default",
+			specs:       []string{"name=docker,size=100,format=qcow2", "size=100"},
+			buses:       []string{"virtio", "virtio"},
+			targets:     []string{"vdb", "vdc"},
+			volumes:     []string{"m1-docker.qcow2", "m1-disk2.img"},
+			files:       []string{"", ""},
+		},
+		{
+			name:    "one ide disk",
+			specs:   []string{"size=100,bus=ide"},
+			buses:   []string{"ide"},
+			targets: []string{"hdb"},
+			volumes: []string{""},
+			files:   []string{"m1-disk1.img"},
+		},
+		{
+			name:    "two ide disks",
+			specs:   []string{"size=100,bus=ide", "size=100,bus=ide"},
+			wantErr: true,
+		},
+		{
+			name:    "scsi next to a scsi machine disk",
+			diskBus: diskBusSCSI,
+			specs:   []string{"path=/dev/sdz"},
+			buses:   []string{"scsi"},
+			targets: []string{"sdb"},
+			volumes: []string{""},
+			files:   []string{""},
+		},
+		{
+			name:    "duplicate names",
+			specs:   []string{"name=data,size=100", "name=data,size=100,keep=true"},
+			wantErr: true,
+		},
+		{
+			name:    "name clashing with a default name",
+			specs:   []string{"size=100", "name=disk1,size=100"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed spec",
+			specs:   []string{"size=big"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{
+				BaseDriver:  &drivers.BaseDriver{MachineName: "m1"},
+				DiskBus:     tt.diskBus,
+				StoragePool: tt.storagePool,
+				CacheMode:   "default",
+			}
+			err := d.setupExtraDisks(tt.specs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setupExtraDisks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			var buses, targets, volumes, files []string
+			for _, disk := range d.ExtraDisks {
+				buses = append(buses, disk.Bus)
+				targets = append(targets, disk.Target)
+				volumes = append(volumes, disk.Volume)
+				files = append(files, disk.File)
+			}
+			if !reflect.DeepEqual(buses, tt.buses) || !reflect.DeepEqual(targets, tt.targets) {
+				t.Errorf("buses %v, targets %v, want %v, %v", buses, targets, tt.buses, tt.targets)
+			}
+			if !reflect.DeepEqual(volumes, tt.volumes) || !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("volumes %v, files %v, want %v, %v", volumes, files, tt.volumes, tt.files)
+			}
+		})
+	}
+}
+
+func TestValidateExtraDisks(t *testing.T) {
+	tests := []struct {
+		name    string
+		ioMode  string
+		disks   []ExtraDisk
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			disks: []ExtraDisk{{Name: "a", Size: 1, Format: "raw", Bus: "virtio", Cache: "default", File: "a.img"}},
+		},
+		{
+			name: "duplicate name",
+			disks: []ExtraDisk{
+				{Name: "a", Format: "raw", Bus: "virtio", Cache: "default", Path: "/dev/sdb"},
+				{Name: "a", Format: "raw", Bus: "virtio", Cache: "default", Path: "/dev/sdc"},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			disks:   []ExtraDisk{{Name: "a", Format: "vmdk", Bus: "virtio", Cache: "default", Path: "/dev/sdb"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown bus",
+			disks:   []ExtraDisk{{Name: "a", Format: "raw", Bus: "usb", Cache: "default", Path: "/dev/sdb"}},
+			wantErr: true,
+		},
+		{
+			name:    "native io needs direct cache",
+			ioMode:  "native",
+			disks:   []ExtraDisk{{Name: "a", Format: "raw", Bus: "virtio", Cache: "default", Path: "/dev/sdb"}},
+			wantErr: true,
+		},
+		{
+			name:    "no size",
+			disks:   []ExtraDisk{{Name: "a", Format: "raw", Bus: "virtio", Cache: "default", File: "a.img"}},
+			wantErr: true,
+		},
+		{
+			name:    "qcow2 without pool",
+			disks:   []ExtraDisk{{Name: "a", Size: 1, Format: "qcow2", Bus: "virtio", Cache: "default", File: "a.qcow2"}},
+			wantErr: true,
+		},
+		{
+			name:    "keep without pool",
+			disks:   []ExtraDisk{{Name: "a", Size: 1, Format: "raw", Bus: "virtio", Cache: "default", File: "a.img", Keep: true}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{IOMode: tt.ioMode, ExtraDisks: tt.disks}
+			if err := d.validateExtraDisks(); (err != nil) != tt.wantErr {
+				t.Errorf("validateExtraDisks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+var nicModels = []string{"virtio", "e1000", "e1000e", "rtl8139"}
+
+// ExtraNetwork is a NIC attached after the public and private ones
+type ExtraNetwork struct {
+	// Either a libvirt network or a host bridge
+	Network string
+	Bridge  string
+	Model   string
+	// Assigned at create time unless given
+	MAC string
+}
+
+// NetworkInterface describes a NIC of the machine
+type NetworkInterface struct {
+	// network, bridge or direct
+	Type string
+	// Name of the libvirt network, host bridge or host device
+	Network string
+	MAC     string
+	// IPv4 address, if one could be discovered
+	Address string
+}
+
+// Parse a --kvm-extra-network value: comma separated key=value pairs out
+// of network, bridge, model and mac
+func parseExtraNetwork(spec string) (ExtraNetwork, error) {
+	var nic ExtraNetwork
+	for _, opt := range strings.Split(spec, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return nic, fmt.Errorf("extra network %q: expected key=value, got %q", spec, opt)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "network":
+			nic.Network = value
+		case "bridge":
+			nic.Bridge = value
+		case "model":
+			nic.Model = value
+		case "mac":
+			nic.MAC = strings.ToLower(value)
+		default:
+			return nic, fmt.Errorf("extra network %q: unknown option %q", spec, key)
+		}
+	}
+	return nic, nil
+}
+
+func (d *Driver) setupExtraNetworks(specs []string) error {
+	d.ExtraNetworks = nil
+	for _, spec := range specs {
+		nic, err := parseExtraNetwork(spec)
+		if err != nil {
+			return err
+		}
+		if nic.Model == "" {
+			nic.Model = "virtio"
+		}
+		d.ExtraNetworks = append(d.ExtraNetworks, nic)
+	}
+	return nil
+}
+
+func (nic ExtraNetwork) String() string {
+	if nic.Bridge != "" {
+		return "bridge " + nic.Bridge
+	}
+	return "network " + nic.Network
+}
+
+func (d *Driver) validateExtraNetworks() error {
+	// Create derives the private MAC address from the machine name and
+	// keeps the others clear of those given here
+	macs := map[string]string{d.privateMAC(): "the private network NIC"}
+	if d.PublicMAC != "" {
+		macs[strings.ToLower(d.PublicMAC)] = "the public NIC"
+	}
+	for _, nic := range d.ExtraNetworks {
+		if (nic.Network == "") == (nic.Bridge == "") {
+			return fmt.Errorf("extra network needs either network= or bridge=")
+		}
+		if !oneOf(nic.Model, nicModels) {
+			return fmt.Errorf("extra network on %s: unsupported model %q, expected one of %v", nic, nic.Model, nicModels)
+		}
+		if nic.MAC != "" {
+			hw, err := net.ParseMAC(nic.MAC)
+			if err != nil || len(hw) != 6 || hw[0]&1 != 0 {
+				return fmt.Errorf("extra network on %s: invalid MAC address %q", nic, nic.MAC)
+			}
+			if other, ok := macs[nic.MAC]; ok {
+				return fmt.Errorf("extra network on %s: MAC address %s is used by %s already", nic, nic.MAC, other)
+			}
+			macs[nic.MAC] = "the extra network on " + nic.String()
+		}
+		var err error
+		if nic.Bridge != "" {
+			err = d.validateHostInterface(nic.Bridge)
+		} else {
+			err = d.validateNetwork(nic.Network)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Give the NICs their MAC addresses, clear of those other machines use.
+// Extra NICs without one get a random one now, so they keep it, and the
+// guest its interface names, when the domain is redefined. No two NICs
+// may share an address, libvirt doesn't check and the guest gets confused
+func (d *Driver) assignMACs() error {
+	used, err := d.macsInUse()
+	if err != nil {
+		return err
+	}
+	return d.setMACs(used)
+}
+
+func (d *Driver) setMACs(used map[string]string) error {
+	for _, nic := range d.ExtraNetworks {
+		if nic.MAC != "" {
+			if other, ok := used[nic.MAC]; ok {
+				return fmt.Errorf("extra network on %s: MAC address %s is used by %s already", nic, nic.MAC, other)
+			}
+			used[nic.MAC] = "the extra network on " + nic.String()
+		}
+	}
+	d.PrivateMAC = choosePrivateMAC(d.MachineName, used)
+	if mac := d.privateMAC(); d.PrivateMAC != mac {
+		log.Infof("MAC address %s is used by %s, using %s on the private network", mac, used[mac], d.PrivateMAC)
+	}
+	used[d.PrivateMAC] = "the private network NIC"
+	var err error
+	if d.PublicMAC, err = uniqueRandomMAC(used); err != nil {
+		return err
+	}
+	used[d.PublicMAC] = "the public NIC"
+	for i := range d.ExtraNetworks {
+		if d.ExtraNetworks[i].MAC != "" {
+			continue
+		}
+		if d.ExtraNetworks[i].MAC, err = uniqueRandomMAC(used); err != nil {
+			return err
+		}
+		used[d.ExtraNetworks[i].MAC] = "the extra network on " + d.ExtraNetworks[i].String()
+	}
+	return nil
+}
+
+func uniqueRandomMAC(used map[string]string) (string, error) {
+	for {
+		mac, err := randomMAC()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := used[mac]; !ok {
+			return mac, nil
+		}
+	}
+}
+
+func (d *Driver) extraNetworkInterfaces() []domainInterface {
+	var ifaces []domainInterface
+	for _, nic := range d.ExtraNetworks {
+		iface := d.networkInterface(nic.Network, nic.MAC)
+		if nic.Bridge != "" {
+			iface.Type = networkModeBridge
+			iface.Source = domainInterfaceSource{Bridge: nic.Bridge}
+		}
+		iface.Model = &domainModel{Type: nic.Model}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces
+}
+
+// Interfaces returns the NICs of the machine in the order the guest sees
+// them, with the address each one got
+func (d *Driver) Interfaces() ([]NetworkInterface, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if d.VM == nil {
+		return nil, fmt.Errorf("domain %s not found", d.MachineName)
+	}
+	xmldoc, err := d.VM.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	var dom domainDef
+	if err := xml.Unmarshal([]byte(xmldoc), &dom); err != nil {
+		return nil, err
+	}
+	var nics []NetworkInterface
+	for _, iface := range dom.Devices.Interfaces {
+		nic := NetworkInterface{Type: iface.Type}
+		switch {
+		case iface.Source.Network != "":
+			nic.Network = iface.Source.Network
+		case iface.Source.Bridge != "":
+			nic.Network = iface.Source.Bridge
+		default:
+			nic.Network = iface.Source.Dev
+		}
+		if iface.MAC != nil {
+			nic.MAC = iface.MAC.Address
+			nic.Address, err = d.lookupInterfaceIP(nic)
+			if err != nil {
+				log.Debugf("No address for %s: %s", nic.MAC, err)
+			}
+		}
+		nics = append(nics, nic)
+	}
+	return nics, nil
+}
+
+// The private network has its own lease lookups, other NICs can only be
+// looked up through the domain
+func (d *Driver) lookupInterfaceIP(nic NetworkInterface) (string, error) {
+	if nic.Type == "network" && nic.Network == d.PrivateNetwork {
+		ip, _, err := d.lookupIP(nic.MAC)
+		return ip, err
+	}
+	order, err := d.ipSourceOrder()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range order {
+		if name == ipSourceDnsmasq || name == ipSourceNetwork {
+			continue
+		}
+		ip, err := ipSources[name](d, nic.MAC)
+		if err != nil {
+			log.Debugf("IP source %s failed: %s", name, err)
+			continue
+		}
+		if ip != "" {
+			return ip, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,102 @@
+package kvm
+
+import (
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+func TestParseExtraNetwork(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    ExtraNetwork
+		wantErr bool
+	}{
+		{spec: "network=storage", want: ExtraNetwork{Network: "storage"}},
+		{
+			spec: "bridge=br1, model=e1000, mac=52:54:00:AB:CD:EF",
+			want: ExtraNetwork{Bridge: "br1", Model: "e1000", MAC: "52:54:00:ab:cd:ef"},
+		},
+		{spec: "network", wantErr: true},
+		{spec: "vlan=42", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseExtraNetwork(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtraNetwork() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseExtraNetwork() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Invalid extra NICs rejected before anything is looked up
+func TestValidateExtraNetworksInvalid(t *testing.T) {
+	d := &Driver{BaseDriver: &drivers.BaseDriver{MachineName: "m1"}, PublicMAC: "52:54:00:11:22:33"}
+	tests := []struct {
+		name string
+		nic  ExtraNetwork
+	}{
+		{name: "neither network nor bridge", nic: ExtraNetwork{Model: "virtio"}},
+		{name: "network and bridge", nic: ExtraNetwork{Network: "storage", Bridge: "br1", Model: "virtio"}},
+		{name: "unknown model", nic: ExtraNetwork{Network: "storage", Model: "ne2k"}},
+		{name: "malformed MAC", nic: ExtraNetwork{Network: "storage", Model: "virtio", MAC: "52:54:00:11:22"}},
+		{name: "multicast MAC", nic: ExtraNetwork{Network: "storage", Model: "virtio", MAC: "01:00:5e:00:00:01"}},
+		{name: "private MAC", nic: ExtraNetwork{Network: "storage", Model: "virtio", MAC: d.privateMAC()}},
+		{name: "public MAC", nic: ExtraNetwork{Network: "storage", Model: "virtio", MAC: "52:54:00:11:22:33"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d.ExtraNetworks = []ExtraNetwork{tt.nic}
+			if err := d.validateExtraNetworks(); err == nil {
+				t.Error("validateExtraNetworks() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestSetMACs(t *testing.T) {
+	newDriver := func(nics ...ExtraNetwork) *Driver {
+		return &Driver{BaseDriver: &drivers.BaseDriver{MachineName: "m1"}, ExtraNetworks: nics}
+	}
+
+	d := newDriver(ExtraNetwork{Network: "a", MAC: "52:54:00:00:00:01"}, ExtraNetwork{Network: "b"})
+	if err := d.setMACs(map[string]string{}); err != nil {
+		t.Fatal(err)
+	}
+	if d.PrivateMAC != d.privateMAC() {
+		t.Errorf("private MAC address %s, want %s", d.PrivateMAC, d.privateMAC())
+	}
+	macs := map[string]bool{}
+	for _, mac := range []string{d.PrivateMAC, d.PublicMAC, d.ExtraNetworks[0].MAC, d.ExtraNetworks[1].MAC} {
+		if mac == "" || macs[mac] {
+			t.Errorf("MAC address %q is missing or used twice", mac)
+		}
+		macs[mac] = true
+	}
+	if d.ExtraNetworks[0].MAC != "52:54:00:00:00:01" {
+		t.Errorf("given MAC address replaced with %s", d.ExtraNetworks[0].MAC)
+	}
+
+	d = newDriver(ExtraNetwork{Network: "a", MAC: "52:54:00:00:00:01"}, ExtraNetwork{Network: "b", MAC: "52:54:00:00:00:01"})
+	if err := d.setMACs(map[string]string{}); err == nil {
+		t.Error("setMACs() accepted two extra NICs with the same MAC address")
+	}
+
+	d = newDriver(ExtraNetwork{Network: "a", MAC: "52:54:00:00:00:01"})
+	if err := d.setMACs(map[string]string{"52:54:00:00:00:01": "domain m2"}); err == nil {
+		t.Error("setMACs() accepted an extra NIC with the MAC address of another domain")
+	}
+
+	d = newDriver()
+	taken := d.privateMAC()
+	if err := d.setMACs(map[string]string{taken: "domain m2"}); err != nil {
+		t.Fatal(err)
+	}
+	if d.PrivateMAC == taken || d.PublicMAC == taken {
+		t.Errorf("MAC address %s of another domain reused", taken)
+	}
+}
@@ -0,0 +1,208 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+const (
+	ignitionFilename = "config.ign"
+	// Spec version of the generated config, understood by Fedora CoreOS
+	// and by Flatcar since 3185
+	ignitionVersion = "3.3.0"
+	// fw_cfg key Ignition reads its config from on QEMU
+	ignitionFwCfgName = "opt/com.coreos/config"
+	// First libvirt release taking fw_cfg entries in <sysinfo>, which it
+	// labels for qemu like any other file of the domain
+	fwCfgSysinfoVersion = 6005000
+)
+
+// The parts of the Ignition spec the driver writes
+type ignitionConfig struct {
+	Ignition struct {
+		Version string         `json:"version"`
+		Config  *ignitionMerge `json:"config,omitempty"`
+	} `json:"ignition"`
+	Passwd struct {
+		Users []ignitionUser `json:"users,omitempty"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []ignitionFile `json:"files,omitempty"`
+	} `json:"storage"`
+}
+
+type ignitionMerge struct {
+	Merge []ignitionResource `json:"merge"`
+}
+
+type ignitionResource struct {
+	Source string `json:"source"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+}
+
+type ignitionFile struct {
+	Path      string           `json:"path"`
+	Mode      int              `json:"mode"`
+	Overwrite bool             `json:"overwrite"`
+	Contents  ignitionResource `json:"contents"`
+}
+
+// Name of the Ignition config inside the storage pool
+func (d *Driver) ignitionVolumeName() string {
+	return fmt.Sprintf("%s-%s", d.MachineName, ignitionFilename)
+}
+
+func (d *Driver) ignitionEnabled() bool {
+	return d.Ignition || d.IgnitionFile != ""
+}
+
+// Check the user supplied config is JSON Ignition can merge with the
+// generated one, so mistakes show up before anything is created
+func validateIgnitionFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Ignition *struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s is not a valid Ignition config: %s", path, err)
+	}
+	if cfg.Ignition == nil || cfg.Ignition.Version == "" {
+		return nil, fmt.Errorf("%s is not a valid Ignition config: ignition.version is missing", path)
+	}
+	if !strings.HasPrefix(cfg.Ignition.Version, "3.") {
+		return nil, fmt.Errorf("%s uses Ignition spec %s, only 3.x configs are supported", path, cfg.Ignition.Version)
+	}
+	return data, nil
+}
+
+func (d *Driver) validateIgnition() error {
+	if !d.ignitionEnabled() {
+		return nil
+	}
+	if d.CloudImage == "" {
+		return errors.New("Ignition needs an image that runs it, use --kvm-cloud-image with a Fedora CoreOS or Flatcar image")
+	}
+	if d.IgnitionFile != "" {
+		_, err := validateIgnitionFile(d.IgnitionFile)
+		return err
+	}
+	return nil
+}
+
+// The config the guest boots with: the machine SSH user and hostname,
+// with the user supplied config merged in
+func (d *Driver) ignitionConfig() ([]byte, error) {
+	pubKey, err := ioutil.ReadFile(d.publicSSHKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	var cfg ignitionConfig
+	cfg.Ignition.Version = ignitionVersion
+	cfg.Passwd.Users = []ignitionUser{{
+		Name:              d.GetSSHUsername(),
+		SSHAuthorizedKeys: []string{strings.TrimSpace(string(pubKey))},
+	}}
+	cfg.Storage.Files = []ignitionFile{
+		{
+			Path:      "/etc/hostname",
+			Mode:      0644,
+			Overwrite: true,
+			Contents:  ignitionResource{Source: "data:," + url.PathEscape(d.MachineName)},
+		},
+		{
+			Path:      "/etc/sudoers.d/docker-machine",
+			Mode:      0440,
+			Overwrite: true,
+			Contents:  ignitionResource{Source: "data:," + url.PathEscape(d.GetSSHUsername()+" ALL=(ALL) NOPASSWD:ALL\n")},
+		},
+	}
+	if d.IgnitionFile != "" {
+		data, err := validateIgnitionFile(d.IgnitionFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Ignition.Config = &ignitionMerge{
+			Merge: []ignitionResource{{Source: "data:;base64," + base64.StdEncoding.EncodeToString(data)}},
+		}
+	}
+	return json.MarshalIndent(cfg, "", "  ")
+}
+
+// Write the Ignition config where qemu can read it and record its path on
+// the libvirtd host. Remote hosts get it as a volume in the storage pool
+func (d *Driver) createIgnitionConfig(layout artifactLayout) error {
+	if err := d.checkFwCfgSupport(); err != nil {
+		return err
+	}
+	cfg, err := d.ignitionConfig()
+	if err != nil {
+		return err
+	}
+	if d.IgnitionVolume != "" {
+		log.Infof("Uploading Ignition config to storage pool %s...", d.StoragePool)
+		pool, err := d.getStoragePool()
+		if err != nil {
+			return err
+		}
+		defer pool.Free()
+		vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, d.IgnitionVolume, len(cfg), diskFormatRaw), 0)
+		if err != nil {
+			log.Warnf("Failed to create volume %s: %s", d.IgnitionVolume, err)
+			return err
+		}
+		defer vol.Free()
+		if err := d.uploadToVolume(vol, bytes.NewReader(cfg), uint64(len(cfg))); err != nil {
+			return err
+		}
+		d.IgnitionConfig, err = vol.GetPath()
+		return err
+	}
+	log.Debugf("Writing Ignition config to %s", layout.local(ignitionFilename))
+	if err := ioutil.WriteFile(layout.local(ignitionFilename), cfg, 0644); err != nil {
+		return err
+	}
+	d.IgnitionConfig = layout.host(ignitionFilename)
+	return layout.setPermissions(ignitionFilename)
+}
+
+// Older libvirt can only pass the config as a raw qemu argument, which
+// qemu may not be allowed to open the file for under SELinux or AppArmor
+func (d *Driver) checkFwCfgSupport() error {
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	version, err := conn.GetLibVersion()
+	if err != nil {
+		return err
+	}
+	d.ignitionQemuArg = version < fwCfgSysinfoVersion
+	if d.ignitionQemuArg {
+		log.Warnf("libvirt %d.%d is older than 6.5, passing the Ignition config on the qemu command line, which SELinux or AppArmor may keep qemu from reading",
+			version/1000000, version/1000%1000)
+	}
+	return nil
+}
+
+// Argument handing the config to the guest over fw_cfg. qemu splits its
+// options on commas, so they have to be doubled in the path
+func (d *Driver) ignitionFwCfg() string {
+	return fmt.Sprintf("name=%s,file=%s", ignitionFwCfgName, strings.Replace(d.IgnitionConfig, ",", ",,", -1))
+}
@@ -0,0 +1,659 @@
+package kvm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/mcnutils"
+)
+
+const (
+	imagesDirname      = "kvm-images"
+	imageIndexFilename = "index.json"
+	imageLockFilename  = "index.json.lock"
+	imageBlobsDirname  = "sha256"
+
+	checksumSidecarSuffix = ".sha256"
+	checksumListFilename  = "SHA256SUMS"
+)
+
+// Servers that don't answer are given up on quickly. There is no limit
+// on the whole download, which can take long on a slow link, it fails
+// once no data arrived for imageIdleTimeout instead
+var imageHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+var imageIdleTimeout = 2 * time.Minute
+
+// Cancels the request of a download when a read hasn't returned any data
+// for timeout
+type idleTimeoutReader struct {
+	body    io.ReadCloser
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	expired int32
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, cancel context.CancelFunc, timeout time.Duration) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, cancel: cancel, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&r.expired, 1)
+		cancel()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if atomic.LoadInt32(&r.expired) == 1 {
+		return n, fmt.Errorf("download stalled, no data for %s", r.timeout)
+	}
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
+
+// ImageCache keeps the ISOs and cloud images machines are created from,
+// keyed by their SHA-256 digest, so they are downloaded and verified once
+// and then shared between machines
+type ImageCache struct {
+	dir string
+}
+
+// CachedImage describes an image in the cache
+type CachedImage struct {
+	Digest string
+	Size   int64
+	// Where the image was fetched from
+	Sources []string
+	// Base volumes created from the image in storage pools
+	Volumes []ImageVolume
+}
+
+// ImageVolume is a copy of a cached image in a storage pool that machine
+// disks are created as overlays of
+type ImageVolume struct {
+	ConnectionString string
+	StoragePool      string
+	Volume           string
+}
+
+// OpenImageCache returns the image cache of a machine store
+func OpenImageCache(storePath string) *ImageCache {
+	return &ImageCache{dir: filepath.Join(storePath, imagesDirname)}
+}
+
+func (c *ImageCache) blobPath(digest string) string {
+	return filepath.Join(c.dir, imageBlobsDirname, digest)
+}
+
+func (c *ImageCache) loadIndex() (map[string]*CachedImage, error) {
+	index := map[string]*CachedImage{}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, imageIndexFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("malformed image cache index: %s", err)
+	}
+	return index, nil
+}
+
+func (c *ImageCache) saveIndex(index map[string]*CachedImage) error {
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, imageIndexFilename+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, imageIndexFilename))
+}
+
+// Take the cache lock, which serialises changes to the index and to the
+// base volumes between concurrent docker-machine runs. Locks are held per
+// open file, so it must not be taken twice by the same process
+func (c *ImageCache) lock() (func(), error) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(c.dir, imageLockFilename), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock the image cache: %s", err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Record a change to the entry of an image in the index
+func (c *ImageCache) update(digest string, fn func(*CachedImage)) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return c.updateLocked(digest, fn)
+}
+
+// update for callers already holding the cache lock
+func (c *ImageCache) updateLocked(digest string, fn func(*CachedImage)) error {
+	index, err := c.loadIndex()
+	if err != nil {
+		return err
+	}
+	img, ok := index[digest]
+	if !ok {
+		img = &CachedImage{Digest: digest}
+		index[digest] = img
+	}
+	fn(img)
+	return c.saveIndex(index)
+}
+
+// List returns the images in the cache
+func (c *ImageCache) List() ([]*CachedImage, error) {
+	index, err := c.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var images []*CachedImage
+	for _, img := range index {
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Digest < images[j].Digest })
+	return images, nil
+}
+
+// Normalise a checksum given as "sha256:<hex>" or just "<hex>"
+func parseChecksum(sum string) (string, error) {
+	sum = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(sum), "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q is not a SHA-256 checksum", sum)
+	}
+	return sum, nil
+}
+
+// Whether src is fetched over http(s) rather than read from this host
+func isRemoteSource(src string) bool {
+	u, err := url.Parse(src)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// Turn a file:// URL into a path, and a directory into the file named
+// defaultName inside it
+func localSource(src, defaultName string) (string, error) {
+	if u, err := url.Parse(src); err == nil && u.Scheme == "file" {
+		src = u.Path
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		if defaultName == "" {
+			return "", fmt.Errorf("%s is a directory, expected an image file", src)
+		}
+		return filepath.Join(src, defaultName), nil
+	}
+	return src, nil
+}
+
+func openSource(src string) (io.ReadCloser, error) {
+	if !isRemoteSource(src) {
+		return os.Open(src)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp, err := imageHTTPClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return nil, fmt.Errorf("unable to download %s: %s", src, resp.Status)
+	}
+	return newIdleTimeoutReader(resp.Body, cancel, imageIdleTimeout), nil
+}
+
+// Look for the checksum of src published next to it, either as
+// <src>.sha256 or as an entry of a SHA256SUMS file
+func sidecarChecksum(src string) string {
+	var dir, name string
+	if isRemoteSource(src) {
+		dir, name = path.Split(src)
+	} else {
+		dir, name = filepath.Split(src)
+	}
+	for _, sidecar := range []string{src + checksumSidecarSuffix, dir + checksumListFilename} {
+		r, err := openSource(sidecar)
+		if err != nil {
+			continue
+		}
+		sum := findChecksum(r, name, strings.HasSuffix(sidecar, checksumSidecarSuffix))
+		r.Close()
+		if sum != "" {
+			log.Debugf("Found checksum of %s in %s", name, sidecar)
+			return sum
+		}
+	}
+	return ""
+}
+
+// Lines look like "<hex>  <name>" or "<hex> *<name>". A sidecar for a
+// single file may leave out the name
+func findChecksum(r io.Reader, name string, single bool) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		sum, err := parseChecksum(fields[0])
+		if err != nil {
+			continue
+		}
+		if single || len(fields) > 1 && strings.TrimPrefix(fields[1], "*") == name {
+			return sum
+		}
+	}
+	return ""
+}
+
+// Fetch returns the path of the cached copy of the image at src, an
+// http(s) URL, a file:// URL, a file or a directory holding a file called
+// defaultName. When mirror is set, a file there with the same name as the
+// image is used instead of downloading it. The image has to match
+// checksum, or the checksum published next to it, if either is known
+func (c *ImageCache) Fetch(src, defaultName, mirror, checksum string) (string, string, error) {
+	if mirror != "" {
+		name := defaultName
+		if src != "" {
+			name = path.Base(src)
+		}
+		candidate := filepath.Join(mirror, name)
+		if name != "" && fileExists(candidate) {
+			log.Infof("Using %s from mirror %s", name, mirror)
+			src = candidate
+		}
+	}
+	if src == "" {
+		return "", "", fmt.Errorf("no source for %s", defaultName)
+	}
+	if !isRemoteSource(src) {
+		local, err := localSource(src, defaultName)
+		if err != nil {
+			return "", "", err
+		}
+		src = local
+	}
+
+	expected := ""
+	if checksum != "" {
+		sum, err := parseChecksum(checksum)
+		if err != nil {
+			return "", "", err
+		}
+		expected = sum
+	} else {
+		expected = sidecarChecksum(src)
+	}
+
+	if expected != "" {
+		if _, err := os.Stat(c.blobPath(expected)); err == nil {
+			log.Debugf("Image %s is cached as %s", src, expected)
+			return c.blobPath(expected), expected, c.addSource(expected, src)
+		}
+	} else {
+		log.Warnf("No checksum known for %s, it will not be verified", src)
+		if isRemoteSource(src) {
+			// Without a checksum all there is to go on is the URL
+			if digest := c.digestOfSource(src); digest != "" {
+				log.Debugf("Image %s was downloaded before as %s", src, digest)
+				return c.blobPath(digest), digest, nil
+			}
+		}
+	}
+
+	digest, err := c.add(src, expected)
+	if err != nil {
+		return "", "", err
+	}
+	return c.blobPath(digest), digest, c.addSource(digest, src)
+}
+
+// Copy src into the cache, hashing it on the way, unless it doesn't match
+// the expected digest
+func (c *ImageCache) add(src, expected string) (string, error) {
+	if err := os.MkdirAll(filepath.Join(c.dir, imageBlobsDirname), 0755); err != nil {
+		return "", err
+	}
+	r, err := openSource(src)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	tmp, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if isRemoteSource(src) {
+		log.Infof("Downloading %s...", src)
+	} else {
+		log.Infof("Copying %s to the image cache...", src)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), r); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && digest != expected {
+		return "", fmt.Errorf("checksum mismatch for %s: expected %s, got %s", src, expected, digest)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+	return digest, os.Rename(tmp.Name(), c.blobPath(digest))
+}
+
+func (c *ImageCache) addSource(digest, src string) error {
+	return c.update(digest, func(img *CachedImage) {
+		if fi, err := os.Stat(c.blobPath(digest)); err == nil {
+			img.Size = fi.Size()
+		}
+		for _, s := range img.Sources {
+			if s == src {
+				return
+			}
+		}
+		img.Sources = append(img.Sources, src)
+	})
+}
+
+func (c *ImageCache) digestOfSource(src string) string {
+	index, err := c.loadIndex()
+	if err != nil {
+		return ""
+	}
+	for digest, img := range index {
+		for _, s := range img.Sources {
+			if s == src {
+				if _, err := os.Stat(c.blobPath(digest)); err == nil {
+					return digest
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Link places a cached image at dst, sharing its blocks with the cache
+// when both are on the same filesystem
+func (c *ImageCache) Link(blob, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(blob, dst); err == nil {
+		return nil
+	}
+	log.Debugf("Unable to hardlink %s, copying it", blob)
+	in, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Prune removes the images no machine uses: base volumes nothing is
+// backed by, and files with no hardlinks left outside the cache. It
+// returns what was removed
+func (c *ImageCache) Prune() ([]string, error) {
+	unlock, err := c.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	index, err := c.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for digest, img := range index {
+		var kept []ImageVolume
+		for _, v := range img.Volumes {
+			inUse, err := v.inUse()
+			if err != nil {
+				log.Warnf("Keeping volume %s in storage pool %s: %s", v.Volume, v.StoragePool, err)
+				kept = append(kept, v)
+				continue
+			}
+			if inUse {
+				kept = append(kept, v)
+				continue
+			}
+			d := v.driver()
+			if err := d.removeVolume(v.Volume); err != nil {
+				log.Warnf("Failed to remove volume %s: %s", v.Volume, err)
+				kept = append(kept, v)
+				continue
+			}
+			removed = append(removed, fmt.Sprintf("volume %s in storage pool %s", v.Volume, v.StoragePool))
+		}
+		img.Volumes = kept
+
+		fi, err := os.Stat(c.blobPath(digest))
+		if err != nil {
+			if os.IsNotExist(err) && len(img.Volumes) == 0 {
+				delete(index, digest)
+			}
+			continue
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 || len(img.Volumes) > 0 {
+			continue
+		}
+		if err := os.Remove(c.blobPath(digest)); err != nil {
+			return removed, err
+		}
+		delete(index, digest)
+		removed = append(removed, "image "+digest)
+	}
+	return removed, c.saveIndex(index)
+}
+
+// A driver that only knows how to reach the volume's pool
+func (v ImageVolume) driver() *Driver {
+	return &Driver{
+		ConnectionString: v.ConnectionString,
+		StoragePool:      v.StoragePool,
+	}
+}
+
+func (v ImageVolume) inUse() (bool, error) {
+	d := v.driver()
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return false, err
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(v.Volume)
+	if err != nil {
+		if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer vol.Free()
+	users, err := d.volumesBackedBy(vol)
+	return len(users) > 0, err
+}
+
+// Put the boot2docker ISO in the machine directory, through the image
+// cache when its source is known
+func (d *Driver) fetchBoot2DockerISO() error {
+	if d.Boot2DockerURL == "" && !d.mirroredISO() {
+		if d.ImageChecksum != "" {
+			return errors.New("--kvm-image-checksum needs --kvm-boot2docker-url, the latest release has no known checksum")
+		}
+		//TODO(r2d4): rewrite this, not using b2dutils
+		b2dutils := mcnutils.NewB2dUtils(d.StorePath)
+		return b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName)
+	}
+	cache := OpenImageCache(d.StorePath)
+	blob, _, err := cache.Fetch(d.Boot2DockerURL, isoFilename, d.ImageMirror, d.ImageChecksum)
+	if err != nil {
+		return err
+	}
+	return cache.Link(blob, d.ResolveStorePath(isoFilename))
+}
+
+// Whether the image mirror has the boot2docker ISO
+func (d *Driver) mirroredISO() bool {
+	return d.ImageMirror != "" && fileExists(filepath.Join(d.ImageMirror, isoFilename))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Name of the base volume of a cached image inside a storage pool
+func imageVolumeName(digest string) string {
+	return fmt.Sprintf("image-%s.qcow2", digest[:12])
+}
+
+// Make sure the storage pool has a base volume holding the cached image
+// and return it
+func (d *Driver) imageVolume(cache *ImageCache, blob, digest string) (*libvirt.StorageVol, error) {
+	name := imageVolumeName(digest)
+	// Another create may be uploading the same image right now
+	unlock, err := cache.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+	if vol, err := pool.LookupStorageVolByName(name); err == nil {
+		log.Debugf("Storage pool %s already has volume %s", d.StoragePool, name)
+		return vol, nil
+	} else if !isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return nil, err
+	}
+
+	f, err := os.Open(blob)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Uploading image to volume %s in storage pool %s...", name, d.StoragePool)
+	vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, name, fi.Size(), diskFormatQcow2), 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", name, err)
+		return nil, err
+	}
+	// The image replaces the empty qcow2 libvirt just wrote, header and all
+	if err := d.uploadToVolume(vol, f, uint64(fi.Size())); err != nil {
+		vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		vol.Free()
+		return nil, err
+	}
+	vol.Free()
+	if err := cache.updateLocked(digest, func(img *CachedImage) {
+		img.Volumes = append(img.Volumes, ImageVolume{
+			ConnectionString: d.ConnectionString,
+			StoragePool:      d.StoragePool,
+			Volume:           name,
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	// libvirt only learns the virtual size of the uploaded image by
+	// looking at the volume again
+	if err := pool.Refresh(0); err != nil {
+		return nil, err
+	}
+	return pool.LookupStorageVolByName(name)
+}
@@ -0,0 +1,86 @@
+package kvm
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenSourceIdleTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { imageIdleTimeout = timeout }(imageIdleTimeout)
+	imageIdleTimeout = 200 * time.Millisecond
+
+	done := make(chan struct{})
+	defer close(done)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Trickle data slower than the whole download may take, but
+		// faster than the idle timeout, then stall
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("data"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+		if r.URL.Path == "/stall" {
+			select {
+			case <-done:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer srv.Close()
+
+	r, err := openSource(srv.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(data) != strings.Repeat("data", 5) {
+		t.Errorf("slow download = %q, %v", data, err)
+	}
+
+	r, err = openSource(srv.URL + "/stall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Errorf("stalled download error = %v", err)
+	}
+}
+
+// Without a mirror a boot2docker.iso in the working directory must not
+// be taken for a mirrored one
+func TestMirroredISO(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "kvm-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := ioutil.WriteFile(filepath.Join(tmp, isoFilename), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmp); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	if (&Driver{}).mirroredISO() {
+		t.Error("mirroredISO() without a mirror = true")
+	}
+	if !(&Driver{ImageMirror: tmp}).mirroredISO() {
+		t.Error("mirroredISO() with the ISO in the mirror = false")
+	}
+	if (&Driver{ImageMirror: filepath.Join(tmp, "empty")}).mirroredISO() {
+		t.Error("mirroredISO() with an empty mirror = true")
+	}
+}
@@ -0,0 +1,117 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+const (
+	// dnsmasq status and lease files of the private network, local
+	// libvirtd only
+	ipSourceDnsmasq = "dnsmasq"
+	// DHCP leases the private network reports through libvirt
+	ipSourceNetwork = "network"
+	// Domain interface addresses, as known to libvirt's DHCP server
+	ipSourceLease = "lease"
+	// Domain interface addresses, as reported by qemu-guest-agent
+	ipSourceAgent = "agent"
+	// Domain interface addresses, from the host ARP table
+	ipSourceARP = "arp"
+
+	// The agent is tried last as it blocks until it times out when the
+	// guest doesn't run one
+	defaultIPSources = "dnsmasq,network,lease,arp,agent"
+)
+
+type ipLookup func(d *Driver, mac string) (string, error)
+
+var ipSources = map[string]ipLookup{
+	ipSourceDnsmasq: (*Driver).getIPByMACFromDnsmasq,
+	ipSourceNetwork: (*Driver).getIPByMacFromSettings,
+	ipSourceLease: func(d *Driver, mac string) (string, error) {
+		return d.getIPByMACFromDomain(mac, libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
+	},
+	ipSourceAgent: func(d *Driver, mac string) (string, error) {
+		return d.getIPByMACFromDomain(mac, libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT)
+	},
+	ipSourceARP: func(d *Driver, mac string) (string, error) {
+		return d.getIPByMACFromDomain(mac, libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_ARP)
+	},
+}
+
+// The configured IP sources, in the order they should be tried
+func (d *Driver) ipSourceOrder() ([]string, error) {
+	value := d.IPSource
+	if value == "" {
+		value = defaultIPSources
+	}
+	var order []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := ipSources[name]; !ok {
+			return nil, fmt.Errorf("unknown IP source %q, expected a list of %s", name, defaultIPSources)
+		}
+		order = append(order, name)
+	}
+	if len(order) == 0 {
+		return nil, errors.New("no IP sources configured")
+	}
+	return order, nil
+}
+
+// Walk the IP sources in order and return the first address found along
+// with the name of the source that produced it
+func (d *Driver) lookupIP(mac string) (string, string, error) {
+	order, err := d.ipSourceOrder()
+	if err != nil {
+		return "", "", err
+	}
+	var errs []string
+	for _, name := range order {
+		ip, err := ipSources[name](d, mac)
+		if err != nil {
+			log.Debugf("IP source %s failed: %s", name, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		if ip != "" {
+			return ip, name, nil
+		}
+	}
+	if len(errs) == len(order) {
+		return "", "", fmt.Errorf("unable to look up IP address for MAC %s: %s", mac, strings.Join(errs, "; "))
+	}
+	return "", "", nil
+}
+
+func (d *Driver) getIPByMACFromDomain(mac string, source libvirt.DomainInterfaceAddressesSource) (string, error) {
+	if err := d.validateVMRef(); err != nil {
+		return "", err
+	}
+	if d.VM == nil {
+		return "", fmt.Errorf("domain %s not found", d.MachineName)
+	}
+	ifaces, err := d.VM.ListAllInterfaceAddresses(source)
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if !strings.EqualFold(iface.Hwaddr, mac) {
+			continue
+		}
+		for _, addr := range iface.Addrs {
+			if libvirt.IPAddrType(addr.Type) == libvirt.IP_ADDR_TYPE_IPV4 {
+				return addr.Addr, nil
+			}
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,190 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Just enough of ISO 9660 to hand a few small files to a guest: a single
+// root directory, no Rock Ridge or Joliet. Linux presents the upper case
+// "NAME;1" identifiers as lower case "name", which is what cloud-init's
+// NoCloud datasource looks for.
+
+const (
+	isoSectorSize = 2048
+	// Sectors 0-15 are the system area
+	isoPVDSector        = 16
+	isoTerminatorSector = 17
+	isoLPathSector      = 18
+	isoMPathSector      = 19
+	isoRootSector       = 20
+	isoFirstFileSector  = 21
+
+	isoPathTableSize = 10
+	isoFlagDirectory = 2
+)
+
+type isoFile struct {
+	name   string
+	data   []byte
+	sector uint32
+}
+
+func isoSectors(size int) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+func putBothEndian16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], v)
+	binary.BigEndian.PutUint16(b[2:4], v)
+}
+
+// Fixed width string field padded with spaces
+func putPadded(b []byte, s string) {
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+// 17 byte date and time format used in the volume descriptor
+func isoVolumeTime(t time.Time) []byte {
+	b := []byte(t.UTC().Format("20060102150405") + "00")
+	return append(b, 0)
+}
+
+// 7 byte date and time format used in directory records
+func isoRecordTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()),
+		byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+func isoDirRecord(id []byte, sector, size uint32, flags byte, modTime time.Time) []byte {
+	length := 33 + len(id)
+	if length%2 != 0 {
+		length++
+	}
+	r := make([]byte, length)
+	r[0] = byte(length)
+	putBothEndian32(r[2:10], sector)
+	putBothEndian32(r[10:18], size)
+	copy(r[18:25], isoRecordTime(modTime))
+	r[25] = flags
+	putBothEndian16(r[28:32], 1)
+	r[32] = byte(len(id))
+	copy(r[33:], id)
+	return r
+}
+
+// The identifier a file is recorded under
+func isoIdentifier(name string) (string, error) {
+	id := strings.ToUpper(name) + ";1"
+	if len(id) > 30 {
+		return "", fmt.Errorf("file name %s is too long for ISO 9660", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("file name %s has characters ISO 9660 doesn't allow", name)
+		}
+	}
+	return id, nil
+}
+
+// writeISO9660 writes an image with the given volume label holding files
+// in its root directory
+func writeISO9660(w io.Writer, label string, files map[string][]byte, modTime time.Time) error {
+	var entries []*isoFile
+	for name, data := range files {
+		id, err := isoIdentifier(name)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &isoFile{name: id, data: data})
+	}
+	// Directory records have to be sorted by identifier
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	sector := uint32(isoFirstFileSector)
+	for _, f := range entries {
+		f.sector = sector
+		sector += isoSectors(len(f.data))
+	}
+	totalSectors := sector
+
+	root := new(bytes.Buffer)
+	root.Write(isoDirRecord([]byte{0}, isoRootSector, isoSectorSize, isoFlagDirectory, modTime))
+	root.Write(isoDirRecord([]byte{1}, isoRootSector, isoSectorSize, isoFlagDirectory, modTime))
+	for _, f := range entries {
+		root.Write(isoDirRecord([]byte(f.name), f.sector, uint32(len(f.data)), 0, modTime))
+	}
+	if root.Len() > isoSectorSize {
+		return fmt.Errorf("too many files for a single sector root directory")
+	}
+
+	img := make([]byte, isoFirstFileSector*isoSectorSize)
+
+	pvd := img[isoPVDSector*isoSectorSize : (isoPVDSector+1)*isoSectorSize]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	pvd[6] = 1
+	putPadded(pvd[8:40], "LINUX")
+	putPadded(pvd[40:72], label)
+	putBothEndian32(pvd[80:88], totalSectors)
+	putBothEndian16(pvd[120:124], 1)
+	putBothEndian16(pvd[124:128], 1)
+	putBothEndian16(pvd[128:132], isoSectorSize)
+	putBothEndian32(pvd[132:140], isoPathTableSize)
+	binary.LittleEndian.PutUint32(pvd[140:144], isoLPathSector)
+	binary.BigEndian.PutUint32(pvd[148:152], isoMPathSector)
+	copy(pvd[156:190], isoDirRecord([]byte{0}, isoRootSector, isoSectorSize, isoFlagDirectory, modTime))
+	putPadded(pvd[190:318], "")
+	putPadded(pvd[318:446], "")
+	putPadded(pvd[446:574], "")
+	putPadded(pvd[574:702], "DOCKER-MACHINE-KVM")
+	putPadded(pvd[702:813], "")
+	copy(pvd[813:830], isoVolumeTime(modTime))
+	copy(pvd[830:847], isoVolumeTime(modTime))
+	copy(pvd[847:864], "0000000000000000\x00")
+	copy(pvd[864:881], isoVolumeTime(modTime))
+	pvd[881] = 1
+
+	term := img[isoTerminatorSector*isoSectorSize:]
+	term[0] = 255
+	copy(term[1:6], "CD001")
+	term[6] = 1
+
+	// Path tables with just the root directory, its own parent
+	lpath := img[isoLPathSector*isoSectorSize:]
+	lpath[0] = 1
+	binary.LittleEndian.PutUint32(lpath[2:6], isoRootSector)
+	binary.LittleEndian.PutUint16(lpath[6:8], 1)
+	mpath := img[isoMPathSector*isoSectorSize:]
+	mpath[0] = 1
+	binary.BigEndian.PutUint32(mpath[2:6], isoRootSector)
+	binary.BigEndian.PutUint16(mpath[6:8], 1)
+
+	copy(img[isoRootSector*isoSectorSize:], root.Bytes())
+
+	if _, err := w.Write(img); err != nil {
+		return err
+	}
+	for _, f := range entries {
+		padded := make([]byte, isoSectors(len(f.data))*isoSectorSize)
+		copy(padded, f.data)
+		if _, err := w.Write(padded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
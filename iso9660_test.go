@@ -0,0 +1,123 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestISOIdentifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "meta-data", want: "META-DATA;1"},
+		{name: "user-data", want: "USER-DATA;1"},
+		{name: "config.ign", want: "CONFIG.IGN;1"},
+		{name: "a_b", want: "A_B;1"},
+		{name: strings.Repeat("x", 28), want: strings.ToUpper(strings.Repeat("x", 28)) + ";1"},
+		{name: strings.Repeat("x", 29), wantErr: true},
+		{name: "with space", wantErr: true},
+		{name: "dir/file", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := isoIdentifier(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// Read the root directory of an image back into identifier -> contents
+func readISORoot(t *testing.T, img []byte) map[string][]byte {
+	t.Helper()
+	pvd := img[isoPVDSector*isoSectorSize:]
+	rootSector := binary.LittleEndian.Uint32(pvd[156+2:])
+	rootSize := binary.LittleEndian.Uint32(pvd[156+10:])
+	dir := img[rootSector*isoSectorSize : rootSector*isoSectorSize+rootSize]
+	files := map[string][]byte{}
+	for i := 0; i < len(dir) && dir[i] != 0; i += int(dir[i]) {
+		r := dir[i:]
+		id := string(r[33 : 33+int(r[32])])
+		if r[25]&isoFlagDirectory != 0 {
+			continue
+		}
+		sector := binary.LittleEndian.Uint32(r[2:])
+		size := binary.LittleEndian.Uint32(r[10:])
+		if binary.BigEndian.Uint32(r[6:]) != sector || binary.BigEndian.Uint32(r[14:]) != size {
+			t.Errorf("%s: little and big endian fields differ", id)
+		}
+		files[id] = img[sector*isoSectorSize : sector*isoSectorSize+size]
+	}
+	return files
+}
+
+func TestWriteISO9660(t *testing.T) {
+	files := map[string][]byte{
+		"user-data":      []byte("#cloud-config\n"),
+		"meta-data":      []byte("instance-id: m1\n"),
+		"network-config": bytes.Repeat([]byte("x"), 3*isoSectorSize+1),
+		"empty":          {},
+	}
+	var buf bytes.Buffer
+	if err := writeISO9660(&buf, seedVolumeLabel, files, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	if len(img)%isoSectorSize != 0 {
+		t.Fatalf("image size %d isn't a multiple of the sector size", len(img))
+	}
+
+	pvd := img[isoPVDSector*isoSectorSize:]
+	if pvd[0] != 1 || string(pvd[1:6]) != "CD001" {
+		t.Fatalf("no primary volume descriptor in sector %d", isoPVDSector)
+	}
+	if label := strings.TrimRight(string(pvd[40:72]), " "); label != seedVolumeLabel {
+		t.Errorf("label = %q, want %q", label, seedVolumeLabel)
+	}
+	if sectors := binary.LittleEndian.Uint32(pvd[80:]); int(sectors)*isoSectorSize != len(img) {
+		t.Errorf("volume has %d sectors, image is %d bytes", sectors, len(img))
+	}
+	if term := img[isoTerminatorSector*isoSectorSize:]; term[0] != 255 || string(term[1:6]) != "CD001" {
+		t.Errorf("no terminator in sector %d", isoTerminatorSector)
+	}
+
+	got := readISORoot(t, img)
+	if len(got) != len(files) {
+		t.Errorf("got %d files, want %d", len(got), len(files))
+	}
+	for name, data := range files {
+		id, _ := isoIdentifier(name)
+		if !bytes.Equal(got[id], data) {
+			t.Errorf("%s: contents differ", id)
+		}
+	}
+}
+
+func TestWriteISO9660Errors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeISO9660(&buf, "x", map[string][]byte{"bad name": nil}, time.Now()); err == nil {
+		t.Error("expected an error for an invalid file name")
+	}
+	many := map[string][]byte{}
+	for i := 0; i < 100; i++ {
+		many[strings.Repeat("f", 20)+string(rune('a'+i%26))+string(rune('a'+i/26))] = nil
+	}
+	if err := writeISO9660(&buf, "x", many, time.Now()); err == nil {
+		t.Error("expected an error for a root directory over one sector")
+	}
+}
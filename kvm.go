@@ -9,12 +9,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
-	"text/template"
-	"time"
-	"syscall"
 
 	libvirt "github.com/libvirt/libvirt-go"
 
@@ -28,78 +25,80 @@ import (
 
 const (
 	connectionString   = "qemu:///system"
+	defaultStoragePool = "default"
 	privateNetworkName = "docker-machines"
-	isoFilename        = "boot2docker.iso"
-	dnsmasqLeases      = "/var/lib/libvirt/dnsmasq/%s.leases"
-	dnsmasqStatus      = "/var/lib/libvirt/dnsmasq/%s.status"
-	defaultSSHUser     = "docker"
-
-	domainXMLTemplate = `<domain type='kvm'>
-  <name>{{.MachineName}}</name> <memory unit='M'>{{.Memory}}</memory>
-  <vcpu>{{.CPU}}</vcpu>
-  <features><acpi/><apic/><pae/></features>
-  <cpu mode='host-passthrough'></cpu>
-  <os>
-    <type>hvm</type>
-    <boot dev='cdrom'/>
-    <boot dev='hd'/>
-    <bootmenu enable='no'/>
-  </os>
-  <devices>
-    <disk type='file' device='cdrom'>
-      <source file='{{.ISO}}'/>
-      <target dev='hdc' bus='ide'/>
-      <readonly/>
-    </disk>
-    <disk type='file' device='disk'>
-      <driver name='qemu' type='raw' cache='{{.CacheMode}}' io='{{.IOMode}}' />
-      <source file='{{.DiskPath}}'/>
-      <target dev='hda' bus='ide'/>
-    </disk>
-    <graphics type='vnc' autoport='yes' websocket='-1' listen='127.0.0.1'>
-      <listen type='address' address='127.0.0.1'/>
-    </graphics>
-    <interface type='network'>
-	  <source network='{{.Network}}'/>
-	  <model type='virtio'/>
-    </interface>
-    <interface type='network'>
-	  <source network='{{.PrivateNetwork}}'/>
-	  <model type='virtio'/>
-    </interface>
-  </devices>
-</domain>`
-	networkXML = `<network>
-  <name>%s</name>
-  <ip address='%s' netmask='%s'>
-    <dhcp>
-      <range start='%s' end='%s'/>
-    </dhcp>
-  </ip>
-</network>`
+	// Machines resolve as <name>.machines.internal on the private network
+	privateNetworkDomain = "machines.internal"
+	isoFilename          = "boot2docker.iso"
+	dnsmasqLeases        = "/var/lib/libvirt/dnsmasq/%s.leases"
+	dnsmasqStatus        = "/var/lib/libvirt/dnsmasq/%s.status"
+	defaultSSHUser       = "docker"
 )
 
 type Driver struct {
 	*drivers.BaseDriver
 
-	Memory           int
-	DiskSize         int
-	Timeout         int
-	CPU              int
-	Network          string
-	PrivateNetwork   string
-	ISO              string
-	Boot2DockerURL   string
-	CaCertPath       string
-	PrivateKeyPath   string
-	DiskPath         string
-	CacheMode        string
-	IOMode           string
-	LibvirtdHostPath string
-	ConnectionString string
-	conn             *libvirt.Connect
-	VM               *libvirt.Domain
-	vmLoaded         bool
+	Memory               int
+	DiskSize             int
+	PendingDiskGrowth    bool
+	BootTimeout          int
+	Timeout              int
+	CPU                  int
+	Network              string
+	NetworkMode          string
+	Bridge               string
+	HostInterface        string
+	OpenVSwitch          bool
+	OVSInterfaceID       string
+	VLANTags             []int
+	Portgroup            string
+	ExtraNetworks        []ExtraNetwork
+	PrivateNetwork       string
+	PrivateNetworkCIDR   string
+	PrivateNetworkDomain string
+	PrivateMAC           string
+	PrivateIP            string
+	PublicMAC            string
+	ISO                  string
+	ISOVolume            string
+	CloudImage           string
+	ImageChecksum        string
+	ImageMirror          string
+	SeedISO              string
+	SeedVolume           string
+	Ignition             bool
+	IgnitionFile         string
+	IgnitionConfig       string
+	IgnitionVolume       string
+	DomainXMLPatch       string
+	Boot2DockerURL       string
+	CaCertPath           string
+	PrivateKeyPath       string
+	DiskPath             string
+	StoragePool          string
+	DiskFormat           string
+	DiskVolume           string
+	Template             string
+	CacheMode            string
+	IOMode               string
+	DiskBus              string
+	DiskDiscard          string
+	DiskDetectZeroes     string
+	ExtraDisks           []ExtraDisk
+	LibvirtdHostPath     string
+	ArtifactDir          string
+	LayoutVersion        int
+	ArtifactGroup        string
+	ConnectionString     string
+	SerialConsole        string
+	ConsoleLog           string
+	IPSource             string
+	IPAddressSource      string
+	conn                 *libvirt.Connect
+	VM                   *libvirt.Domain
+	vmLoaded             bool
+	growRebooted         bool
+	ignitionQemuArg      bool
 }
 
 func (d *Driver) GetCreateFlags() []mcnflag.Flag {
@@ -116,8 +115,8 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		},
 		mcnflag.IntFlag{
 			Name:  "kvm-timeout",
-			Usage: "Number of Seconds to wait for VM to come up",
-			Value: 90,
+			Usage: "Maximum number of seconds to wait for the VM to come up or shut down",
+			Value: defaultTimeout,
 		},
 		mcnflag.IntFlag{
 			Name:  "kvm-cpu-count",
@@ -129,12 +128,105 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage: "Name of network to connect to",
 			Value: "default",
 		},
+		mcnflag.StringFlag{
+			Name:  "kvm-network-mode",
+			Usage: "How the public interface is connected: network, bridge or direct (macvtap)",
+			Value: networkModeNetwork,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-bridge",
+			Usage: "Host bridge the public interface is attached to in bridge mode",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-host-interface",
+			Usage: "Host device the public interface shares through macvtap in direct mode",
+		},
+		mcnflag.BoolFlag{
+			Name:  "kvm-openvswitch",
+			Usage: "Attach the public interface to an Open vSwitch bridge or network",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-ovs-interface-id",
+			Usage: "Open vSwitch interface ID (a UUID) of the public interface, implies --kvm-openvswitch",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-vlan",
+			Usage: "VLAN tag of the public interface, or a comma separated list of tags to trunk",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-portgroup",
+			Usage: "Portgroup of the libvirt network the public interface uses",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-network",
+			Usage: "Name of the host private network, created if it doesn't exist",
+			Value: privateNetworkName,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-network-cidr",
+			Usage: "Subnet of the private network when it has to be created, or \"auto\" to pick one that doesn't conflict",
+			Value: autoCIDR,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-network-domain",
+			Usage: "DNS domain of the private network when it has to be created, machines resolve as <name>.<domain>",
+			Value: privateNetworkDomain,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-private-ip",
+			Usage: "Address reserved for the machine on the private network, picked from the DHCP range if not given",
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KVM_BOOT2DOCKER_URL",
 			Name:   "kvm-boot2docker-url",
 			Usage:  "The URL of the boot2docker image. Defaults to the latest available version",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_CLOUD_IMAGE",
+			Name:   "kvm-cloud-image",
+			Usage:  "Path or URL of a qcow2 cloud image (Ubuntu, Debian, Fedora...) to boot instead of boot2docker, set up with cloud-init",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_IMAGE_CHECKSUM",
+			Name:   "kvm-image-checksum",
+			Usage:  "SHA-256 checksum the cloud image, or else the boot2docker ISO, has to match. Defaults to the checksum published next to it, if any",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_IMAGE_MIRROR",
+			Name:   "kvm-image-mirror",
+			Usage:  "Local directory to take images from, by file name, instead of downloading them",
+			Value:  "",
+		},
+		mcnflag.BoolFlag{
+			Name:  "kvm-ignition",
+			Usage: "Configure the cloud image with Ignition (Fedora CoreOS, Flatcar) instead of cloud-init",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_IGNITION_FILE",
+			Name:   "kvm-ignition-file",
+			Usage:  "Ignition config (spec 3.x) merged with the generated one, implies --kvm-ignition",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_STORAGE_POOL",
+			Name:   "kvm-storage-pool",
+			Usage:  "Libvirt storage pool to create the disk in. Defaults to a raw file in the machine directory",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-disk-format",
+			Usage: "Disk format: raw, qcow2 (qcow2 requires --kvm-storage-pool)",
+			Value: diskFormatRaw,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_TEMPLATE",
+			Name:   "kvm-template",
+			Usage:  "Template to create the disk as a copy-on-write clone of, see docker-machine-kvm-ctl template",
+			Value:  "",
+		},
 		mcnflag.StringFlag{
 			Name:  "kvm-cache-mode",
 			Usage: "Disk cache mode: default, none, writethrough, writeback, directsync, or unsafe",
@@ -145,6 +237,31 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 			Usage: "Disk IO mode: threads, native",
 			Value: "threads",
 		},
+		mcnflag.StringFlag{
+			Name:  "kvm-disk-bus",
+			Usage: "Bus the disk is attached to: ide, sata, virtio or scsi (virtio-scsi)",
+			Value: diskBusIDE,
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-disk-discard",
+			Usage: "Whether discard (TRIM) requests from the guest are passed on to the disk image: ignore or unmap. Defaults to the hypervisor's default",
+			Value: "",
+		},
+		mcnflag.StringFlag{
+			Name:  "kvm-disk-detect-zeroes",
+			Usage: "Turn guest writes of zeroes into sparse regions: off, on or unmap (needs --kvm-disk-discard unmap)",
+			Value: "",
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "kvm-extra-network",
+			Usage: "Additional NIC, as comma separated network= or bridge=, model= and mac= options. Can be repeated",
+			Value: []string{},
+		},
+		mcnflag.StringSliceFlag{
+			Name:  "kvm-extra-disk",
+			Usage: "Additional data disk, as comma separated name=, size= (MB), format=, bus=, cache=, path= (existing file or device) and keep=true options. Can be repeated",
+			Value: []string{},
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KVM_SSH_USER",
 			Name:   "kvm-ssh-user",
@@ -154,9 +271,38 @@ func (d *Driver) GetCreateFlags() []mcnflag.Flag {
 		mcnflag.StringFlag{
 			EnvVar: "KVM_LIBVIRTD_HOST_PATH",
 			Name:   "kvm-libvirtd-host-path",
-			Usage:  "Location of iso and disk on the libvirtd host",
+			Usage:  "Location of the artifact directory on the libvirtd host",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_ARTIFACT_DIR",
+			Name:   "kvm-artifact-dir",
+			Usage:  "Directory to keep the ISO, disk and logs of each machine in. Defaults to the machine directory",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_ARTIFACT_GROUP",
+			Name:   "kvm-artifact-group",
+			Usage:  "Group (e.g. kvm or libvirt-qemu) given access to the machine artifacts instead of relying on libvirt dynamic ownership",
+			Value:  "",
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_DOMAIN_XML_PATCH",
+			Name:   "kvm-domain-xml-patch",
+			Usage:  "File with a <domain> fragment or a <patch> of add, replace and remove operations applied to the generated domain XML",
 			Value:  "",
 		},
+		mcnflag.StringFlag{
+			Name:  "kvm-serial-console",
+			Usage: "Serial console of the VM: log (pty logged to a file in the artifact directory), file, pty or none",
+			Value: serialConsoleLog,
+		},
+		mcnflag.StringFlag{
+			EnvVar: "KVM_IP_SOURCE",
+			Name:   "kvm-ip-source",
+			Usage:  "Comma separated list of sources to look up the VM's IP address in, in order: dnsmasq, network, lease, arp, agent",
+			Value:  defaultIPSources,
+		},
 		mcnflag.StringFlag{
 			EnvVar: "KVM_LIBVIRTD_CONNECTION_STRING",
 			Name:   "kvm-libvirtd-connection-string",
@@ -202,14 +348,47 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	log.Debugf("SetConfigFromFlags called")
 	d.Memory = flags.Int("kvm-memory")
 	d.DiskSize = flags.Int("kvm-disk-size")
-	d.Timeout = flags.Int("kvm-timeout")	
+	d.BootTimeout = flags.Int("kvm-timeout")
 	d.CPU = flags.Int("kvm-cpu-count")
 	d.Network = flags.String("kvm-network")
+	d.NetworkMode = flags.String("kvm-network-mode")
+	if d.NetworkMode == networkModeMacvtap {
+		d.NetworkMode = networkModeDirect
+	}
+	d.Bridge = flags.String("kvm-bridge")
+	d.HostInterface = flags.String("kvm-host-interface")
+	d.OVSInterfaceID = flags.String("kvm-ovs-interface-id")
+	d.OpenVSwitch = flags.Bool("kvm-openvswitch") || d.OVSInterfaceID != ""
+	vlans, err := parseVLANTags(flags.String("kvm-vlan"))
+	if err != nil {
+		return err
+	}
+	d.VLANTags = vlans
+	d.Portgroup = flags.String("kvm-portgroup")
+	d.PrivateNetwork = flags.String("kvm-private-network")
+	d.PrivateNetworkCIDR = flags.String("kvm-private-network-cidr")
+	d.PrivateNetworkDomain = flags.String("kvm-private-network-domain")
+	if err := validateDNSDomain(d.PrivateNetworkDomain); err != nil {
+		return err
+	}
+	d.PrivateIP = flags.String("kvm-private-ip")
 	d.Boot2DockerURL = flags.String("kvm-boot2docker-url")
 	d.CacheMode = flags.String("kvm-cache-mode")
 	d.IOMode = flags.String("kvm-io-mode")
+	d.DiskBus = flags.String("kvm-disk-bus")
+	d.DiskDiscard = flags.String("kvm-disk-discard")
+	d.DiskDetectZeroes = flags.String("kvm-disk-detect-zeroes")
 	d.LibvirtdHostPath = flags.String("kvm-libvirtd-host-path")
+	d.ArtifactDir = flags.String("kvm-artifact-dir")
+	d.ArtifactGroup = flags.String("kvm-artifact-group")
 	d.ConnectionString = flags.String("kvm-libvirtd-connection-string")
+	d.LayoutVersion = artifactLayoutVersion
+	if d.LibvirtdHostPath != "" && d.ArtifactDir == "" && !d.isRemote() {
+		return fmt.Errorf("--kvm-libvirtd-host-path needs --kvm-artifact-dir, the directory the driver sees the host path at")
+	}
+	d.IPSource = flags.String("kvm-ip-source")
+	d.SerialConsole = flags.String("kvm-serial-console")
+	d.DomainXMLPatch = flags.String("kvm-domain-xml-patch")
 	d.SwarmMaster = flags.Bool("swarm-master")
 	d.SwarmHost = flags.String("swarm-host")
 	d.SwarmDiscovery = flags.String("swarm-discovery")
@@ -217,7 +396,61 @@ func (d *Driver) SetConfigFromFlags(flags drivers.DriverOptions) error {
 	d.SSHUser = flags.String("kvm-ssh-user")
 	d.SSHPort = 22
 	d.DiskPath = d.ResolveStorePath(fmt.Sprintf("%s.img", d.MachineName))
-	return nil
+	d.StoragePool = flags.String("kvm-storage-pool")
+	d.DiskFormat = flags.String("kvm-disk-format")
+	d.Template = flags.String("kvm-template")
+	d.CloudImage = flags.String("kvm-cloud-image")
+	d.ImageChecksum = flags.String("kvm-image-checksum")
+	d.ImageMirror = flags.String("kvm-image-mirror")
+	d.Ignition = flags.Bool("kvm-ignition")
+	d.IgnitionFile = flags.String("kvm-ignition-file")
+	if d.CloudImage != "" {
+		if d.Template != "" {
+			return errors.New("--kvm-cloud-image and --kvm-template can't be used together")
+		}
+		// The image is uploaded into a pool and grown there
+		if d.StoragePool == "" {
+			d.StoragePool = defaultStoragePool
+		}
+		d.DiskFormat = diskFormatQcow2
+		d.ISO = ""
+	}
+	if d.Template != "" {
+		t, err := LoadTemplate(d.StorePath, d.Template)
+		if err != nil {
+			return err
+		}
+		if d.ConnectionString != t.ConnectionString {
+			return fmt.Errorf("template %s lives on %s, not %s", t.Name, t.ConnectionString, d.ConnectionString)
+		}
+		if d.StoragePool != "" && d.StoragePool != t.StoragePool {
+			return fmt.Errorf("template %s lives in storage pool %s, not %s", t.Name, t.StoragePool, d.StoragePool)
+		}
+		// Clones have to sit next to their backing volume
+		d.StoragePool = t.StoragePool
+		d.DiskFormat = diskFormatQcow2
+	}
+	if d.isRemote() {
+		// Nothing on this host is reachable by a remote libvirtd, so the
+		// ISO and disk have to be uploaded into a pool
+		if d.StoragePool == "" {
+			d.StoragePool = defaultStoragePool
+		}
+		if d.ignitionEnabled() {
+			d.IgnitionVolume = d.ignitionVolumeName()
+		} else if d.CloudImage != "" {
+			d.SeedVolume = d.seedVolumeName()
+		} else {
+			d.ISOVolume = d.isoVolumeName()
+		}
+	}
+	if d.StoragePool != "" {
+		d.DiskVolume = d.diskVolumeName()
+	}
+	if err := d.setupExtraNetworks(flags.StringSlice("kvm-extra-network")); err != nil {
+		return err
+	}
+	return d.setupExtraDisks(flags.StringSlice("kvm-extra-disk"))
 }
 
 func (d *Driver) GetURL() (string, error) {
@@ -233,8 +466,20 @@ func (d *Driver) GetURL() (string, error) {
 	return fmt.Sprintf("tcp://%s:2376", ip), nil // TODO - don't hardcode the port!
 }
 
+// Whether libvirtd runs on another host, e.g. qemu+ssh://host/system
+func (d *Driver) isRemote() bool {
+	u, err := url.Parse(d.ConnectionString)
+	if err != nil {
+		return false
+	}
+	return u.Host != "" && u.Hostname() != "localhost"
+}
+
 func (d *Driver) getConn() (*libvirt.Connect, error) {
 	if d.conn == nil {
+		if err := startEventLoop(); err != nil {
+			log.Debugf("Failed to start the libvirt event loop: %s", err)
+		}
 		conn, err := libvirt.NewConnect(d.ConnectionString)
 		if err != nil {
 			log.Errorf("Failed to connect to libvirt: %s", err)
@@ -258,31 +503,23 @@ func (d *Driver) validatePrivateNetwork() error {
 		if err != nil {
 			return err
 		}
-		/* XML structure:
-		<network>
-		    ...
-		    <ip address='a.b.c.d' netmask='255.255.255.0'>
-		        <dhcp>
-		            <range start='a.b.c.d' end='w.x.y.z'/>
-		        </dhcp>
-		*/
-		type Ip struct {
-			Address string `xml:"address,attr"`
-			Netmask string `xml:"netmask,attr"`
-		}
-		type Network struct {
-			Ip Ip `xml:"ip"`
-		}
-
-		var nw Network
-		err = xml.Unmarshal([]byte(xmldoc), &nw)
+		nw, err := parseNetworkXML(xmldoc)
 		if err != nil {
 			return err
 		}
-
-		if nw.Ip.Address == "" {
+		cidr := nw.ipv4Net()
+		if cidr == nil {
 			return fmt.Errorf("%s network doesn't have DHCP configured properly", d.PrivateNetwork)
 		}
+		if d.PrivateNetworkCIDR != autoCIDR && d.PrivateNetworkCIDR != cidr.String() {
+			log.Warnf("Private network %s already uses %s, ignoring %s", d.PrivateNetwork, cidr, d.PrivateNetworkCIDR)
+		}
+		d.PrivateNetworkCIDR = cidr.String()
+		domain := nw.domain()
+		if d.PrivateNetworkDomain != privateNetworkDomain && d.PrivateNetworkDomain != domain {
+			log.Warnf("Private network %s already uses domain %q, ignoring %s", d.PrivateNetwork, domain, d.PrivateNetworkDomain)
+		}
+		d.PrivateNetworkDomain = domain
 		// Corner case, but might happen...
 		if active, err := network.IsActive(); !active {
 			log.Debugf("Reactivating private network: %s", err)
@@ -294,19 +531,21 @@ func (d *Driver) validatePrivateNetwork() error {
 		}
 		return nil
 	}
-	// TODO - try a couple pre-defined networks and look for conflicts before
-	//        settling on one
-	xml := fmt.Sprintf(networkXML, d.PrivateNetwork,
-		"192.168.42.1",
-		"255.255.255.0",
-		"192.168.42.2",
-		"192.168.42.254")
-
+	cidr, err := d.choosePrivateCIDR()
+	if err != nil {
+		return err
+	}
+	log.Infof("Creating private network %s with %s", d.PrivateNetwork, cidr)
+	xml, err := privateNetworkXML(d.PrivateNetwork, d.PrivateNetworkDomain, cidr)
+	if err != nil {
+		return err
+	}
 	network, err = conn.NetworkDefineXML(xml)
 	if err != nil {
 		log.Errorf("Failed to create private network: %s", err)
-		return nil
+		return err
 	}
+	d.PrivateNetworkCIDR = cidr.String()
 	err = network.SetAutostart(true)
 	if err != nil {
 		log.Warnf("Failed to set private network to autostart: %s", err)
@@ -353,10 +592,50 @@ func (d *Driver) PreCreateCheck() error {
 	if err != nil {
 		return err
 	}
-	err = d.validateNetwork(d.Network)
+	err = d.validatePrivateIP()
+	if err != nil {
+		return err
+	}
+	err = d.validatePublicInterface()
+	if err != nil {
+		return err
+	}
+	err = d.validateStoragePool()
 	if err != nil {
 		return err
 	}
+	_, err = d.ipSourceOrder()
+	if err != nil {
+		return err
+	}
+	err = validateSerialConsole(d.SerialConsole)
+	if err != nil {
+		return err
+	}
+	err = d.validateExtraNetworks()
+	if err != nil {
+		return err
+	}
+	err = d.validateDomainOptions()
+	if err != nil {
+		return err
+	}
+	err = d.validateExtraDisks()
+	if err != nil {
+		return err
+	}
+	err = d.validateIgnition()
+	if err != nil {
+		return err
+	}
+	if d.DomainXMLPatch != "" {
+		if _, err := loadDomainPatch(d.DomainXMLPatch); err != nil {
+			return err
+		}
+	}
+	if d.isRemote() && (d.LibvirtdHostPath != "" || d.ArtifactDir != "") {
+		log.Warnf("Ignoring the artifact directory, the ISO and disk are uploaded to storage pool %s", d.StoragePool)
+	}
 	// Others...?
 	return nil
 }
@@ -364,93 +643,161 @@ func (d *Driver) publicSSHKeyPath() string {
 	return d.GetSSHKeyPath() + ".pub"
 }
 
-func (d *Driver) Create() error {
+func (d *Driver) Create() (err error) {
 
-	//TODO(r2d4): rewrite this, not using b2dutils
-	b2dutils := mcnutils.NewB2dUtils(d.StorePath)
-	if err := b2dutils.CopyIsoToMachineDir(d.Boot2DockerURL, d.MachineName); err != nil {
-		return err
+	if d.CloudImage == "" {
+		if err := d.fetchBoot2DockerISO(); err != nil {
+			return err
+		}
+	}
+
+	var base *Template
+	if d.Template != "" {
+		t, err := LoadTemplate(d.StorePath, d.Template)
+		if err != nil {
+			return err
+		}
+		base = t
+		log.Infof("Using ssh key of template %s...", base.Name)
+		if err := d.copyTemplateSSHKey(base); err != nil {
+			return err
+		}
+	} else {
+		log.Info("Creating ssh key...")
+		if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+			return err
+		}
 	}
 
-	log.Info("Creating ssh key...")
-	if err := ssh.GenerateSSHKey(d.GetSSHKeyPath()); err != nil {
+	if err := d.assignMACs(); err != nil {
+		return err
+	}
+	if err := d.reservePrivateIP(); err != nil {
+		return err
+	}
+	// Until the domain is defined nothing refers to the reservation and
+	// DNS records, drop them if creating it fails so a retry starts clean
+	defer func() {
+		if err != nil && d.VM == nil {
+			d.unregisterDNSHost()
+			d.releasePrivateIP()
+		}
+	}()
+	if err := d.registerDNSHost(); err != nil {
 		return err
 	}
 
-	log.Info("Creating raw disk image...")
-	//TODO: REVIEW THIS LINE
-	//diskPath := GetDiskPath(d)
-	if _, err := os.Stat(d.DiskPath); os.IsNotExist(err) {
-		if err := createRawDiskImage( d.publicSSHKeyPath(), d.DiskPath, d.DiskSize); err != nil {
+	if base != nil {
+		log.Infof("Cloning volume %s of template %s...", base.Volume, base.Name)
+		if err := d.createCloneVolume(base); err != nil {
+			return err
+		}
+		d.DiskPath = ""
+	} else if d.CloudImage != "" {
+		log.Infof("Creating volume from cloud image %s in storage pool %s...", d.CloudImage, d.StoragePool)
+		if err := d.createCloudImageVolume(); err != nil {
 			return err
 		}
-		if err := fixPermissions(d.ResolveStorePath(".")); err != nil {
+		d.DiskPath = ""
+	} else if d.StoragePool != "" {
+		log.Infof("Creating %s volume in storage pool %s...", d.DiskFormat, d.StoragePool)
+		if err := d.createDiskVolume(); err != nil {
 			return err
 		}
+		d.DiskPath = ""
 	}
-	log.Info("Testing ISO Path: %s",d.ISO)
-	log.Info("Testing DISK Path: %s",d.DiskPath)
-	log.Info("Testing Local Path: %s",d.ResolveStorePath("."))
-	log.Debugf("Defining VM...")
-	prepareKVMDiskAndISO(d.DiskPath,d.ISO,d.MachineName)
-	if d.LibvirtdHostPath != "" {
-		
-		d.ISO = fmt.Sprintf("%s/%s_persistant/boot2docker.iso",d.LibvirtdHostPath, d.MachineName)
-		d.DiskPath = fmt.Sprintf("%s/%s_persistant/%s.img",d.LibvirtdHostPath, d.MachineName,d.MachineName)
+	layout := d.layout()
+	if d.isRemote() {
+		if d.ISOVolume != "" {
+			log.Infof("Uploading %s to storage pool %s...", isoFilename, d.StoragePool)
+			if err := d.uploadFileToVolume(d.ISOVolume, d.ResolveStorePath(isoFilename)); err != nil {
+				return err
+			}
+		}
+	} else {
+		log.Debugf("Preparing artifact directory %s", layout.dir)
+		if err := layout.prepare(); err != nil {
+			return err
+		}
+		if err := d.prepareKVMDiskAndISO(layout); err != nil {
+			return err
+		}
 	}
-	tmpl, err := template.New("domain").Parse(domainXMLTemplate)
-	if err != nil {
+	if err := d.createExtraDisks(layout); err != nil {
 		return err
 	}
-	var xml bytes.Buffer
-	err = tmpl.Execute(&xml, d)
+	if d.ignitionEnabled() {
+		if err := d.createIgnitionConfig(layout); err != nil {
+			return err
+		}
+	} else if d.CloudImage != "" {
+		if err := d.createSeed(layout); err != nil {
+			return err
+		}
+	}
+	if d.consoleLogged() {
+		d.ConsoleLog = d.hostConsoleLog()
+		log.Debugf("Console log: %s", d.ConsoleLog)
+	}
+	log.Debugf("ISO path: %s", d.ISO)
+	log.Debugf("Disk path: %s", d.DiskPath)
+	log.Debugf("Defining VM...")
+	xml, err := d.domainXML()
 	if err != nil {
 		return err
 	}
+	if d.DomainXMLPatch != "" {
+		log.Debugf("Applying domain XML patch %s", d.DomainXMLPatch)
+		xml, err = patchDomainXML(xml, d.DomainXMLPatch)
+		if err != nil {
+			return err
+		}
+	}
+	// Keep what was actually defined, for reference
+	if err := ioutil.WriteFile(d.ResolveStorePath(domainXMLFilename), []byte(xml), 0644); err != nil {
+		return err
+	}
 
 	conn, err := d.getConn()
 	if err != nil {
 		return err
 	}
-	vm, err := conn.DomainDefineXML(xml.String())
+	vm, err := conn.DomainDefineXML(xml)
 	if err != nil {
 		log.Warnf("Failed to create the VM: %s", err)
 		return err
 	}
 	d.VM = vm
 	d.vmLoaded = true
-	//TODO: (HACK) FIX FILE PERMISSION ISSUE WITH LONG TERM FIX 
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s",d.MachineName), 0o777)
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s/machines",d.MachineName), 0o777)
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s/machines/%s",d.MachineName,d.MachineName), 0o777)
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s/machines/%s/config.json",d.MachineName,d.MachineName), 0o777)
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s/machines/%s/id_rsa.pub",d.MachineName,d.MachineName), 0o400)
-	err = os.Chmod(fmt.Sprintf("/management-state/node/nodes/%s/machines/%s/id_rsa",d.MachineName,d.MachineName), 0o400)
-
-	if err != nil {
-		log.Warnf("Failed to open file permssions: %s", err)
-	}
 	return d.Start()
 }
 
-func prepareKVMDiskAndISO(diskPath string, isoPath string, machineName string) error {
-	err := os.Mkdir(fmt.Sprintf("/management-state/node/nodes/%s_persistant",machineName), 0755)
-	if err != nil {
-		return err
-	}
-	diskNewPath := fmt.Sprintf("/management-state/node/nodes/%s_persistant/%s.img",machineName,machineName)
-	isoNewPath := fmt.Sprintf("/management-state/node/nodes/%s_persistant/boot2docker.iso",machineName)
-	err = os.Rename(diskPath, diskNewPath)
-	if err != nil {
-		return err
-	}
-	err = os.Rename(isoPath, isoNewPath)
-	if err != nil {
-		return err
+// Place the ISO and the raw disk in the artifact layout and point the
+// domain definition at them as libvirtd will see them
+func (d *Driver) prepareKVMDiskAndISO(layout artifactLayout) error {
+	var files []string
+	if d.CloudImage == "" {
+		if err := layout.adopt(d.ResolveStorePath(isoFilename), isoFilename); err != nil {
+			return err
+		}
+		d.ISO = layout.host(isoFilename)
+		files = append(files, isoFilename)
 	}
-	return nil
- }
 
+	if d.StoragePool == "" {
+		diskFilename := fmt.Sprintf("%s.img", d.MachineName)
+		diskPath := layout.local(diskFilename)
+		if _, err := os.Stat(diskPath); os.IsNotExist(err) {
+			log.Info("Creating raw disk image...")
+			if err := createRawDiskImage(d.publicSSHKeyPath(), diskPath, d.DiskSize); err != nil {
+				return err
+			}
+		}
+		d.DiskPath = layout.host(diskFilename)
+		files = append(files, diskFilename)
+	}
+	return layout.setPermissions(files...)
+}
 
 func createRawDiskImage(sshKeyPath, diskPath string, diskSizeMb int) error {
 	//tarBuf, err := mcnutils.MakeDiskImage(sshKeyPath)
@@ -484,25 +831,20 @@ func (d *Driver) Start() error {
 	if err := d.validateVMRef(); err != nil {
 		return err
 	}
+	events, cancel := d.watchLifecycle()
+	defer cancel()
 	if err := d.VM.Create(); err != nil {
 		log.Warnf("Failed to start: %s", err)
 		return err
 	}
-
-	// They wont start immediately
-	time.Sleep(time.Duration(d.Timeout) * time.Second)
-
-	for i := 0; i < 350; i++ {
-		time.Sleep(time.Second)
-		ip, _ := d.GetIP()
-		if ip != "" {
-			// Add a second to let things settle
-			time.Sleep(time.Second)
-			return nil
+	if err := d.waitForBoot(events); err != nil {
+		return err
+	}
+	if d.PendingDiskGrowth {
+		if err := d.growDiskFilesystem(); err != nil {
+			log.Warnf("Failed to grow the filesystem, will retry on next start: %s", err)
 		}
-		log.Debugf("Waiting for the VM to come up... %d", i)
 	}
-	log.Warnf("Unable to determine VM's IP address, did it fail to boot?")
 	return nil
 }
 
@@ -517,20 +859,14 @@ func (d *Driver) Stop() error {
 	}
 
 	if s != state.Stopped {
+		events, cancel := d.watchLifecycle()
+		defer cancel()
 		err := d.VM.Shutdown()
 		if err != nil {
 			log.Warnf("Failed to gracefully shutdown VM")
 			return err
 		}
-		for i := 0; i < 90; i++ {
-			time.Sleep(time.Second)
-			s, _ := d.GetState()
-			log.Debugf("VM state: %s", s)
-			if s == state.Stopped {
-				return nil
-			}
-		}
-		return errors.New("VM Failed to gracefully shutdown, try the kill command")
+		return d.waitForShutdown(events)
 	}
 	return nil
 }
@@ -540,15 +876,37 @@ func (d *Driver) Remove() error {
 	if err := d.validateVMRef(); err != nil {
 		return err
 	}
-	err := os.RemoveAll(fmt.Sprintf("/management-state/node/nodes/%s_persistant",d.MachineName))
-    if err != nil {
+	// The domain may be gone already, or never have been defined when
+	// Create failed halfway, what it left behind is removed regardless
+	if d.VM != nil {
+		d.VM.Destroy() // Ignore errors
+		// Undefine fails while snapshot metadata is around
+		d.removeSnapshotMetadata()
+	} else {
+		log.Warnf("Domain %s not found, removing what is left of it", d.MachineName)
+	}
+	for _, name := range []string{d.DiskVolume, d.ISOVolume, d.SeedVolume, d.IgnitionVolume} {
+		if name == "" {
+			continue
+		}
+		if err := d.removeVolume(name); err != nil {
+			return err
+		}
+	}
+	if err := d.removeExtraDisks(); err != nil {
 		return err
-    }
-	// Note: If we switch to qcow disks instead of raw the user
-	//       could take a snapshot.  If you do, then Undefine
-	//       will fail unless we nuke the snapshots first
-	d.VM.Destroy() // Ignore errors
-	return d.VM.Undefine()
+	}
+	d.unregisterDNSHost()
+	d.releasePrivateIP()
+	if !d.isRemote() {
+		if err := d.layout().remove(); err != nil {
+			return err
+		}
+	}
+	if d.VM == nil {
+		return nil
+	}
+	return d.VM.UndefineFlags(libvirt.DOMAIN_UNDEFINE_SNAPSHOTS_METADATA)
 }
 
 func (d *Driver) Restart() error {
@@ -622,6 +980,9 @@ func (d *Driver) getMAC() (string, error) {
 	if err := d.validateVMRef(); err != nil {
 		return "", err
 	}
+	if d.VM == nil {
+		return "", fmt.Errorf("domain %s not found", d.MachineName)
+	}
 	xmldoc, err := d.VM.GetXMLDesc(0)
 	if err != nil {
 		return "", err
@@ -634,39 +995,46 @@ func (d *Driver) getMAC() (string, error) {
 	        <interface type='network'>
 	            ...
 	            <mac address='52:54:00:d2:3f:ba'/>
+	            <source network='docker-machines'/>
 	            ...
 	        </interface>
 	        ...
 	*/
-	type Mac struct {
-		Address string `xml:"address,attr"`
-	}
-	type Source struct {
-		Network string `xml:"network,attr"`
-	}
-	type Interface struct {
-		Type   string `xml:"type,attr"`
-		Mac    Mac    `xml:"mac"`
-		Source Source `xml:"source"`
-	}
-	type Devices struct {
-		Interfaces []Interface `xml:"interface"`
-	}
-	type Domain struct {
-		Devices Devices `xml:"devices"`
-	}
-
-	var dom Domain
+	var dom domainDef
 	err = xml.Unmarshal([]byte(xmldoc), &dom)
 	if err != nil {
 		return "", err
 	}
-	// Always assume the second interface is the one we want
-	if len(dom.Devices.Interfaces) < 2 {
-		return "", fmt.Errorf("VM doesn't have enough network interfaces.  Expected at least 2, found %d",
-			len(dom.Devices.Interfaces))
+	// Prefer the MAC we assigned, it survives the interface being moved
+	// around with virsh edit
+	if d.PrivateMAC != "" {
+		for _, iface := range dom.Devices.Interfaces {
+			if iface.MAC != nil && strings.EqualFold(iface.MAC.Address, d.PrivateMAC) {
+				return iface.MAC.Address, nil
+			}
+		}
 	}
-	return dom.Devices.Interfaces[1].Mac.Address, nil
+	var found []string
+	for _, iface := range dom.Devices.Interfaces {
+		if iface.Type == "network" && iface.Source.Network == d.PrivateNetwork && iface.MAC != nil {
+			return iface.MAC.Address, nil
+		}
+		switch {
+		case iface.Source.Network != "":
+			found = append(found, iface.Source.Network)
+		case iface.Source.Bridge != "":
+			found = append(found, "bridge "+iface.Source.Bridge)
+		case iface.Source.Dev != "":
+			found = append(found, "device "+iface.Source.Dev)
+		default:
+			found = append(found, iface.Type)
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("VM has no network interfaces, expected one on network %s", d.PrivateNetwork)
+	}
+	return "", fmt.Errorf("VM has no network interface on network %s, found: %s",
+		d.PrivateNetwork, strings.Join(found, ", "))
 }
 
 func (d *Driver) getIPByMACFromLeaseFile(mac string) (string, error) {
@@ -699,12 +1067,11 @@ func (d *Driver) getIPByMacFromSettings(mac string) (string, error) {
 		return "", err
 	}
 	network, err := conn.LookupNetworkByName(d.PrivateNetwork)
-	networkName, err := network.GetName()
 	if err != nil {
 		log.Warnf("Failed to find network: %s", err)
 		return "", err
 	}
-	log.Info("Pulled network from libvirt: %s", networkName)
+	defer network.Free()
 	dhcpLeases, err := network.GetDHCPLeases()
 	if err != nil {
 		log.Warnf("Failed to get DHCP Leases: %s", err)
@@ -713,9 +1080,9 @@ func (d *Driver) getIPByMacFromSettings(mac string) (string, error) {
 	ipAddr := ""
 
 	for _, l := range dhcpLeases {
-		if mac == l.Mac {
+		if strings.EqualFold(mac, l.Mac) {
 			ipAddr = l.IPaddr
-		}	
+		}
 	}
 
 	return ipAddr, nil
@@ -727,18 +1094,12 @@ func (d *Driver) GetIP() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	/*
-	 * TODO - Figure out what version of libvirt changed behavior and
-	 *        be smarter about selecting which algorithm to use
-	 */
-	ip, err := d.getIPByMACFromLeaseFile(mac)
-	if ip == "" {
-		ip, err = d.getIPByMacFromSettings(mac)
-	}
+	ip, source, err := d.lookupIP(mac)
 	if ip != "" {
-	 	d.IPAddress = ip
+		log.Debugf("IP address %s found via %s", ip, source)
+		d.IPAddress = ip
+		d.IPAddressSource = source
 	}
-	//log.Debugf("Unable to locate IP address for MAC %s", mac)
 	return ip, err
 }
 
@@ -811,7 +1172,10 @@ func createDiskImage(dest string, size int, r io.Reader) error {
 
 func NewDriver(hostName, storePath string) drivers.Driver {
 	return &Driver{
-		PrivateNetwork: privateNetworkName,
+		PrivateNetwork:       privateNetworkName,
+		PrivateNetworkCIDR:   autoCIDR,
+		PrivateNetworkDomain: privateNetworkDomain,
+		SerialConsole:        serialConsoleNone,
 		BaseDriver: &drivers.BaseDriver{
 			SSHUser:     defaultSSHUser,
 			MachineName: hostName,
@@ -819,14 +1183,3 @@ func NewDriver(hostName, storePath string) drivers.Driver {
 		},
 	}
 }
-func fixPermissions(path string) error {
-	os.Chown(path, syscall.Getuid(), syscall.Getegid())
-	files, _ := ioutil.ReadDir(path)
-	for _, f := range files {
-		fp := filepath.Join(path, f.Name())
-		if err := os.Chown(fp, syscall.Getuid(), syscall.Getegid()); err != nil {
-			return err
-		}
-	}
-	return nil
-}
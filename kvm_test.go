@@ -0,0 +1,38 @@
+package kvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+// Removing a machine whose domain is gone, because Create failed before
+// defining it or it was undefined by hand, cleans up what is left
+func TestRemoveWithoutDomain(t *testing.T) {
+	root, err := ioutil.TempDir("", "kvm-remove")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	d := &Driver{
+		BaseDriver:  &drivers.BaseDriver{MachineName: "gone", StorePath: root},
+		ArtifactDir: root,
+		vmLoaded:    true,
+	}
+	dir := d.layout().dir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "gone.img"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(); err != nil {
+		t.Fatalf("Remove() = %s", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("artifact directory %s left behind", dir)
+	}
+}
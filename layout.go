@@ -0,0 +1,201 @@
+package kvm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+const (
+	// Machines created by earlier releases keep their artifacts in
+	// <root>/<machine>_persistant, so stay compatible with that layout
+	artifactDirSuffix = "_persistant"
+	// Where those releases kept them when only --kvm-libvirtd-host-path
+	// was given, the Rancher/Unraid container layout
+	legacyArtifactDir = "/management-state/node/nodes"
+	// Saved in the config of new machines. Configs without it come from
+	// releases that used legacyArtifactDir
+	artifactLayoutVersion = 1
+
+	seedFilename       = "seed.iso"
+	logsDirname        = "logs"
+	consoleLogFilename = "console.log"
+)
+
+// artifactLayout describes where the files backing a machine (disk, ISO,
+// seed media and logs) live, both as seen by the driver and as seen by
+// libvirtd when the directory is mounted elsewhere on the hypervisor
+type artifactLayout struct {
+	dir     string
+	hostDir string
+	// Whether dir is owned by the driver rather than by docker-machine
+	owned bool
+	group string
+}
+
+func (d *Driver) layout() artifactLayout {
+	l := artifactLayout{
+		dir:   d.ResolveStorePath("."),
+		group: d.ArtifactGroup,
+	}
+	root := d.ArtifactDir
+	if root == "" && d.LibvirtdHostPath != "" && d.LayoutVersion == 0 {
+		root = legacyArtifactDir
+	}
+	if root != "" {
+		l.dir = filepath.Join(root, d.MachineName+artifactDirSuffix)
+		l.owned = true
+	}
+	l.hostDir = l.dir
+	if d.LibvirtdHostPath != "" {
+		l.hostDir = filepath.Join(d.LibvirtdHostPath, d.MachineName+artifactDirSuffix)
+	}
+	return l
+}
+
+func (l artifactLayout) local(name string) string {
+	return filepath.Join(l.dir, name)
+}
+
+func (l artifactLayout) host(name string) string {
+	return filepath.Join(l.hostDir, name)
+}
+
+func (l artifactLayout) consoleLog() string {
+	return l.local(filepath.Join(logsDirname, consoleLogFilename))
+}
+
+func (l artifactLayout) hostConsoleLog() string {
+	return l.host(filepath.Join(logsDirname, consoleLogFilename))
+}
+
+// Create the artifact directories with permissions that let the qemu
+// process reach them without making anything world-writable
+func (l artifactLayout) prepare() error {
+	gid, err := l.gid()
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{l.dir, l.local(logsDirname)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := setOwnership(dir, gid, 0755, 0770); err != nil {
+			return err
+		}
+	}
+	// qemu opens file consoles itself and may not be able to create
+	// files in the logs directory, so have one ready for it
+	f, err := os.OpenFile(l.consoleLog(), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return setOwnership(l.consoleLog(), gid, 0644, 0660)
+}
+
+// Fix up ownership of the files the driver placed in the layout
+func (l artifactLayout) setPermissions(names ...string) error {
+	gid, err := l.gid()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := setOwnership(l.local(name), gid, 0644, 0660); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move a file produced in the machine directory into the layout
+func (l artifactLayout) adopt(src, name string) error {
+	dst := l.local(name)
+	if src == dst {
+		return nil
+	}
+	log.Debugf("Moving %s to %s", src, dst)
+	err := renameFile(src, dst)
+	if lerr, ok := err.(*os.LinkError); ok && lerr.Err == syscall.EXDEV {
+		// The artifact directory is on another filesystem
+		return moveFile(src, dst)
+	}
+	return err
+}
+
+// Replaced in tests to fake a rename across filesystems
+var renameFile = os.Rename
+
+// Copy src to dst and remove src, for when they can't be renamed
+func moveFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+func (l artifactLayout) remove() error {
+	if !l.owned {
+		// docker-machine removes the machine directory itself
+		return nil
+	}
+	log.Debugf("Removing artifact directory %s", l.dir)
+	return os.RemoveAll(l.dir)
+}
+
+// The group artifacts are shared with, or -1 to leave ownership alone
+func (l artifactLayout) gid() (int, error) {
+	if l.group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(l.group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(l.group)
+	if err != nil {
+		return -1, fmt.Errorf("unable to find artifact group %s: %s", l.group, err)
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// Without a group, rely on libvirt's dynamic ownership and keep the files
+// readable; with one, hand the group the access qemu needs instead
+func setOwnership(path string, gid int, mode, groupMode os.FileMode) error {
+	if gid < 0 {
+		return os.Chmod(path, mode)
+	}
+	if err := os.Chown(path, os.Getuid(), gid); err != nil {
+		return err
+	}
+	return os.Chmod(path, groupMode)
+}
@@ -0,0 +1,129 @@
+package kvm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+func TestLayout(t *testing.T) {
+	tests := []struct {
+		name             string
+		artifactDir      string
+		libvirtdHostPath string
+		layoutVersion    int
+		dir              string
+		hostDir          string
+		owned            bool
+	}{
+		{
+			name:    "machine directory",
+			dir:     "/store/machines/m1",
+			hostDir: "/store/machines/m1",
+		},
+		{
+			name:             "host path without artifact dir",
+			layoutVersion:    artifactLayoutVersion,
+			libvirtdHostPath: "/mnt/user/rancher",
+			dir:              "/store/machines/m1",
+			hostDir:          "/mnt/user/rancher/m1_persistant",
+		},
+		{
+			name:        "artifact dir",
+			artifactDir: "/srv/kvm",
+			dir:         "/srv/kvm/m1_persistant",
+			hostDir:     "/srv/kvm/m1_persistant",
+			owned:       true,
+		},
+		{
+			name:             "legacy host path",
+			layoutVersion:    0,
+			libvirtdHostPath: "/mnt/user/rancher",
+			dir:              "/management-state/node/nodes/m1_persistant",
+			hostDir:          "/mnt/user/rancher/m1_persistant",
+			owned:            true,
+		},
+		{
+			name:             "artifact dir and host path",
+			artifactDir:      "/srv/kvm",
+			libvirtdHostPath: "/mnt/kvm",
+			dir:              "/srv/kvm/m1_persistant",
+			hostDir:          "/mnt/kvm/m1_persistant",
+			owned:            true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{
+				BaseDriver:       &drivers.BaseDriver{MachineName: "m1", StorePath: "/store"},
+				ArtifactDir:      tt.artifactDir,
+				LibvirtdHostPath: tt.libvirtdHostPath,
+				LayoutVersion:    tt.layoutVersion,
+			}
+			l := d.layout()
+			if l.dir != tt.dir {
+				t.Errorf("dir = %s, want %s", l.dir, tt.dir)
+			}
+			if l.hostDir != tt.hostDir {
+				t.Errorf("hostDir = %s, want %s", l.hostDir, tt.hostDir)
+			}
+			if l.owned != tt.owned {
+				t.Errorf("owned = %v, want %v", l.owned, tt.owned)
+			}
+			if got, want := l.host(isoFilename), tt.hostDir+"/"+isoFilename; got != want {
+				t.Errorf("host(%s) = %s, want %s", isoFilename, got, want)
+			}
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	tests := []struct {
+		name   string
+		rename func(src, dst string) error
+	}{
+		{name: "rename", rename: os.Rename},
+		{
+			name: "across filesystems",
+			rename: func(src, dst string) error {
+				return &os.LinkError{Op: "rename", Old: src, New: dst, Err: syscall.EXDEV}
+			},
+		},
+	}
+	defer func() { renameFile = os.Rename }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renameFile = tt.rename
+			tmp, err := ioutil.TempDir("", "kvm-adopt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			l := artifactLayout{dir: filepath.Join(tmp, "artifacts")}
+			if err := os.Mkdir(l.dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			src := filepath.Join(tmp, "disk.img")
+			if err := ioutil.WriteFile(src, []byte("payload"), 0640); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.adopt(src, "disk.img"); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(l.local("disk.img"))
+			if err != nil || string(data) != "payload" {
+				t.Errorf("adopted file = %q, %v", data, err)
+			}
+			if fi, err := os.Stat(l.local("disk.img")); err != nil || fi.Mode().Perm() != 0640 {
+				t.Errorf("adopted file mode = %v, %v", fi.Mode(), err)
+			}
+			if _, err := os.Stat(src); !os.IsNotExist(err) {
+				t.Errorf("%s left behind", src)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package kvm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+const (
+	// Pick the first candidate that doesn't overlap with anything in use
+	autoCIDR = "auto"
+
+	procNetRoute = "/proc/net/route"
+
+	// OUI qemu and libvirt use for generated addresses
+	qemuOUI = "52:54:00"
+)
+
+// Ranges tried, in order, when the private network CIDR is "auto"
+var privateNetworkCandidates = []string{
+	"192.168.42.0/24",
+	"192.168.43.0/24",
+	"192.168.44.0/24",
+	"192.168.45.0/24",
+	"192.168.142.0/24",
+	"172.30.42.0/24",
+	"172.31.42.0/24",
+	"10.42.42.0/24",
+	"10.142.42.0/24",
+}
+
+// A host name label as RFC 1123 allows it
+var dnsLabelPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// XML structure:
+//
+//	<network>
+//	    <name>docker-machines</name>
+//	    <domain name='machines.internal' localOnly='yes'/>
+//	    <dns>
+//	        <host ip='a.b.c.e'>
+//	            <hostname>mymachine</hostname>
+//	            <hostname>mymachine.machines.internal</hostname>
+//	        </host>
+//	    </dns>
+//	    ...
+//	    <ip address='a.b.c.d' netmask='255.255.255.0'>
+//	        <dhcp>
+//	            <range start='a.b.c.d' end='w.x.y.z'/>
+//	            <host mac='52:54:00:..' name='mymachine' ip='a.b.c.e'/>
+//	        </dhcp>
+//	    </ip>
+//	</network>
+type networkIP struct {
+	Address string       `xml:"address,attr"`
+	Netmask string       `xml:"netmask,attr"`
+	Prefix  string       `xml:"prefix,attr,omitempty"`
+	Family  string       `xml:"family,attr,omitempty"`
+	DHCP    *networkDHCP `xml:"dhcp"`
+}
+
+type networkDHCP struct {
+	Ranges []networkDHCPRange `xml:"range"`
+	Hosts  []networkDHCPHost  `xml:"host"`
+}
+
+type networkDHCPRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type networkDHCPHost struct {
+	XMLName xml.Name `xml:"host"`
+	MAC     string   `xml:"mac,attr,omitempty"`
+	Name    string   `xml:"name,attr,omitempty"`
+	IP      string   `xml:"ip,attr,omitempty"`
+}
+
+func (h networkDHCPHost) String() string {
+	if h.Name != "" {
+		return fmt.Sprintf("%s (%s)", h.Name, h.MAC)
+	}
+	return h.MAC
+}
+
+type networkDef struct {
+	XMLName     xml.Name            `xml:"network"`
+	Name        string              `xml:"name"`
+	Domain      *networkDomain      `xml:"domain"`
+	DNS         *networkDNS         `xml:"dns"`
+	IPs         []networkIP         `xml:"ip"`
+	VirtualPort *networkVirtualPort `xml:"virtualport"`
+	Portgroups  []networkPortgroup  `xml:"portgroup"`
+}
+
+type networkDomain struct {
+	Name string `xml:"name,attr"`
+	// Names in the domain that dnsmasq can't resolve aren't forwarded
+	LocalOnly string `xml:"localOnly,attr,omitempty"`
+}
+
+type networkDNS struct {
+	Hosts []networkDNSHost `xml:"host"`
+}
+
+type networkDNSHost struct {
+	XMLName   xml.Name `xml:"host"`
+	IP        string   `xml:"ip,attr"`
+	Hostnames []string `xml:"hostname"`
+}
+
+type networkVirtualPort struct {
+	Type string `xml:"type,attr"`
+}
+
+type networkPortgroup struct {
+	Name string `xml:"name,attr"`
+}
+
+func parseNetworkXML(xmldoc string) (*networkDef, error) {
+	var nw networkDef
+	if err := xml.Unmarshal([]byte(xmldoc), &nw); err != nil {
+		return nil, err
+	}
+	return &nw, nil
+}
+
+// The subnet an <ip> element describes, or nil if it isn't IPv4
+func (ip networkIP) ipNet() *net.IPNet {
+	if ip.Family != "" && ip.Family != "ipv4" {
+		return nil
+	}
+	addr := net.ParseIP(ip.Address).To4()
+	if addr == nil {
+		return nil
+	}
+	mask := net.CIDRMask(24, 32)
+	if ip.Netmask != "" {
+		mask = net.IPMask(net.ParseIP(ip.Netmask).To4())
+	} else if ip.Prefix != "" {
+		prefix, err := strconv.Atoi(ip.Prefix)
+		if err != nil {
+			return nil
+		}
+		mask = net.CIDRMask(prefix, 32)
+	}
+	return &net.IPNet{IP: addr.Mask(mask), Mask: mask}
+}
+
+// The first IPv4 subnet of the network
+func (nw *networkDef) ipv4Net() *net.IPNet {
+	if ip := nw.ipv4(); ip != nil {
+		return ip.ipNet()
+	}
+	return nil
+}
+
+// The first <ip> element of the network describing an IPv4 subnet
+func (nw *networkDef) ipv4() *networkIP {
+	for i := range nw.IPs {
+		if nw.IPs[i].ipNet() != nil {
+			return &nw.IPs[i]
+		}
+	}
+	return nil
+}
+
+// The DNS domain of the network, empty if it has none
+func (nw *networkDef) domain() string {
+	if nw.Domain == nil {
+		return ""
+	}
+	return nw.Domain.Name
+}
+
+func (nw *networkDef) dnsHosts() []networkDNSHost {
+	if nw.DNS == nil {
+		return nil
+	}
+	return nw.DNS.Hosts
+}
+
+func (ip *networkIP) dhcpHosts() []networkDHCPHost {
+	if ip == nil || ip.DHCP == nil {
+		return nil
+	}
+	return ip.DHCP.Hosts
+}
+
+// The network and broadcast addresses of an IPv4 subnet
+func subnetBounds(cidr *net.IPNet) (uint32, uint32) {
+	ones, bits := cidr.Mask.Size()
+	first := binary.BigEndian.Uint32(cidr.IP.To4().Mask(cidr.Mask))
+	return first, first + uint32(1)<<uint(bits-ones) - 1
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// Network definition for cidr, with the first address as the gateway and
+// the rest of the subnet, minus the broadcast address, handed out by DHCP
+func privateNetworkXML(name, domain string, cidr *net.IPNet) (string, error) {
+	base := cidr.IP.To4()
+	ones, bits := cidr.Mask.Size()
+	if base == nil || bits != 32 {
+		return "", fmt.Errorf("private network %s must be an IPv4 subnet", cidr)
+	}
+	if bits-ones < 2 {
+		return "", fmt.Errorf("private network %s is too small", cidr)
+	}
+	first, last := subnetBounds(cidr)
+	nw := networkDef{
+		Name: name,
+		IPs: []networkIP{{
+			Address: uint32ToIP(first + 1).String(),
+			Netmask: net.IP(cidr.Mask).String(),
+			DHCP: &networkDHCP{
+				Ranges: []networkDHCPRange{{Start: uint32ToIP(first + 2).String(), End: uint32ToIP(last - 1).String()}},
+			},
+		}},
+	}
+	if domain != "" {
+		nw.Domain = &networkDomain{Name: domain, LocalOnly: "yes"}
+	}
+	data, err := xml.MarshalIndent(nw, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Check a DNS domain is made of RFC 1123 labels. Empty means none
+func validateDNSDomain(domain string) error {
+	if domain == "" {
+		return nil
+	}
+	if len(domain) > 253 {
+		return fmt.Errorf("DNS domain %q is longer than 253 characters", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !dnsLabelPattern.MatchString(label) {
+			return fmt.Errorf("invalid DNS domain %q: label %q has to be 1-63 letters, digits or hyphens, not starting or ending with a hyphen", domain, label)
+		}
+	}
+	return nil
+}
+
+// Choose the subnet for a new private network, either the configured one
+// or the first candidate that doesn't conflict with anything in use
+func (d *Driver) choosePrivateCIDR() (*net.IPNet, error) {
+	if d.PrivateNetworkCIDR != autoCIDR {
+		_, cidr, err := net.ParseCIDR(d.PrivateNetworkCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private network CIDR %q: %s", d.PrivateNetworkCIDR, err)
+		}
+		return cidr, nil
+	}
+	used, err := d.usedSubnets()
+	if err != nil {
+		return nil, err
+	}
+	return firstFreeCIDR(privateNetworkCandidates, used)
+}
+
+// The first of the candidate subnets that doesn't overlap any used one
+func firstFreeCIDR(candidates []string, used []*net.IPNet) (*net.IPNet, error) {
+	for _, candidate := range candidates {
+		_, cidr, _ := net.ParseCIDR(candidate)
+		conflict := false
+		for _, u := range used {
+			if overlaps(cidr, u) {
+				log.Debugf("Private network candidate %s conflicts with %s", cidr, u)
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			return cidr, nil
+		}
+	}
+	return nil, fmt.Errorf("all candidate private networks are in use (%s), use --kvm-private-network-cidr to pick one",
+		strings.Join(candidates, ", "))
+}
+
+// Subnets used by libvirt networks and, when libvirtd is local, by the
+// host's interfaces and routes
+func (d *Driver) usedSubnets() ([]*net.IPNet, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	networks, err := conn.ListAllNetworks(0)
+	if err != nil {
+		return nil, err
+	}
+	var used []*net.IPNet
+	for _, network := range networks {
+		xmldoc, err := network.GetXMLDesc(0)
+		network.Free()
+		if err != nil {
+			return nil, err
+		}
+		nw, err := parseNetworkXML(xmldoc)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range nw.IPs {
+			if ipnet := ip.ipNet(); ipnet != nil {
+				used = append(used, ipnet)
+			}
+		}
+	}
+	if d.isRemote() {
+		// The host interfaces that matter are on the libvirtd host
+		return used, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			used = append(used, &net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask})
+		}
+	}
+	routes, err := hostRoutes()
+	if err != nil {
+		log.Debugf("Unable to read host routes: %s", err)
+	}
+	return append(used, routes...), nil
+}
+
+// Parse the IPv4 routing table, skipping default routes
+func hostRoutes() ([]*net.IPNet, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var routes []*net.IPNet
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dest, err := strconv.ParseUint(fields[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		mask, err := strconv.ParseUint(fields[7], 16, 32)
+		if err != nil || mask == 0 {
+			continue
+		}
+		// Addresses are in host byte order, assume little endian as on
+		// x86 and arm64
+		routes = append(routes, &net.IPNet{
+			IP:   net.IPv4(byte(dest), byte(dest>>8), byte(dest>>16), byte(dest>>24)).To4(),
+			Mask: net.IPv4Mask(byte(mask), byte(mask>>8), byte(mask>>16), byte(mask>>24)),
+		})
+	}
+	return routes, scanner.Err()
+}
+
+// Random MAC address in the range libvirt would pick from
+func randomMAC() (string, error) {
+	buf := make([]byte, 3)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%02x:%02x:%02x", qemuOUI, buf[0], buf[1], buf[2]), nil
+}
@@ -0,0 +1,167 @@
+package kvm
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cidr
+}
+
+func TestFirstFreeCIDR(t *testing.T) {
+	tests := []struct {
+		name string
+		used []string
+		want string
+	}{
+		{"nothing used", nil, "192.168.42.0/24"},
+		{"first taken", []string{"192.168.42.0/24"}, "192.168.43.0/24"},
+		{"supernet taken", []string{"192.168.0.0/16"}, "172.30.42.0/24"},
+		{"subnet taken", []string{"192.168.42.128/25", "192.168.43.1/32"}, "192.168.44.0/24"},
+		{"unrelated", []string{"10.0.0.0/24"}, "192.168.42.0/24"},
+		{"all taken", []string{"192.168.0.0/16", "172.16.0.0/12", "10.0.0.0/8"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var used []*net.IPNet
+			for _, u := range tt.used {
+				used = append(used, mustCIDR(t, u))
+			}
+			got, err := firstFreeCIDR(privateNetworkCandidates, used)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChoosePrivateCIDRExplicit(t *testing.T) {
+	d := &Driver{PrivateNetworkCIDR: "10.1.2.0/24"}
+	got, err := d.choosePrivateCIDR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "10.1.2.0/24" {
+		t.Errorf("got %s, want 10.1.2.0/24", got)
+	}
+	d.PrivateNetworkCIDR = "10.1.2.0"
+	if _, err := d.choosePrivateCIDR(); err == nil {
+		t.Error("expected an error for a CIDR without prefix length")
+	}
+}
+
+func TestPrivateNetworkXML(t *testing.T) {
+	tests := []struct {
+		cidr                 string
+		gateway, netmask     string
+		rangeStart, rangeEnd string
+		wantErr              bool
+	}{
+		{cidr: "192.168.42.0/24", gateway: "192.168.42.1", netmask: "255.255.255.0", rangeStart: "192.168.42.2", rangeEnd: "192.168.42.254"},
+		{cidr: "10.42.0.0/16", gateway: "10.42.0.1", netmask: "255.255.0.0", rangeStart: "10.42.0.2", rangeEnd: "10.42.255.254"},
+		{cidr: "172.30.42.0/30", gateway: "172.30.42.1", netmask: "255.255.255.252", rangeStart: "172.30.42.2", rangeEnd: "172.30.42.2"},
+		{cidr: "172.30.42.0/31", wantErr: true},
+		{cidr: "fd00::/64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			doc, err := privateNetworkXML("docker-machines", "machines.internal", mustCIDR(t, tt.cidr))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", doc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			nw, err := parseNetworkXML(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nw.Name != "docker-machines" {
+				t.Errorf("name = %s", nw.Name)
+			}
+			if nw.domain() != "machines.internal" || nw.Domain.LocalOnly != "yes" {
+				t.Errorf("domain = %+v", nw.Domain)
+			}
+			ip := nw.ipv4()
+			if ip == nil {
+				t.Fatalf("no IPv4 address in %s", doc)
+			}
+			if ip.Address != tt.gateway || ip.Netmask != tt.netmask {
+				t.Errorf("ip = %s/%s, want %s/%s", ip.Address, ip.Netmask, tt.gateway, tt.netmask)
+			}
+			if ip.DHCP == nil || len(ip.DHCP.Ranges) != 1 {
+				t.Fatalf("no DHCP range in %s", doc)
+			}
+			if r := ip.DHCP.Ranges[0]; r.Start != tt.rangeStart || r.End != tt.rangeEnd {
+				t.Errorf("range = %s-%s, want %s-%s", r.Start, r.End, tt.rangeStart, tt.rangeEnd)
+			}
+			if got := nw.ipv4Net().String(); got != tt.cidr {
+				t.Errorf("ipv4Net = %s, want %s", got, tt.cidr)
+			}
+		})
+	}
+}
+
+// Names end up escaped and an empty domain leaves the element out
+func TestPrivateNetworkXMLEscaping(t *testing.T) {
+	doc, err := privateNetworkXML("a'b<c>&d", "", mustCIDR(t, "192.168.42.0/24"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw, err := parseNetworkXML(doc)
+	if err != nil {
+		t.Fatalf("%s: %s", err, doc)
+	}
+	if nw.Name != "a'b<c>&d" {
+		t.Errorf("name = %s", nw.Name)
+	}
+	if nw.Domain != nil {
+		t.Errorf("domain = %+v, want none", nw.Domain)
+	}
+}
+
+func TestValidateDNSDomain(t *testing.T) {
+	tests := []struct {
+		domain  string
+		wantErr bool
+	}{
+		{domain: ""},
+		{domain: "machines.internal"},
+		{domain: "lab-1.example.com"},
+		{domain: "1a.example"},
+		{domain: "machines.internal.", wantErr: true},
+		{domain: ".internal", wantErr: true},
+		{domain: "-lab.internal", wantErr: true},
+		{domain: "lab-.internal", wantErr: true},
+		{domain: "lab_1.internal", wantErr: true},
+		{domain: "machines'/><foo bar='", wantErr: true},
+		{domain: strings.Repeat("a", 64) + ".internal", wantErr: true},
+		{domain: strings.Repeat(strings.Repeat("a", 63)+".", 4) + "internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			if err := validateDNSDomain(tt.domain); (err != nil) != tt.wantErr {
+				t.Errorf("validateDNSDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package kvm
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// How the public interface, the first NIC, is connected
+const (
+	networkModeNetwork = "network"
+	networkModeBridge  = "bridge"
+	networkModeDirect  = "direct"
+	// Alias of direct, macvtap is what libvirt creates for it
+	networkModeMacvtap = "macvtap"
+)
+
+var networkModes = []string{networkModeNetwork, networkModeBridge, networkModeDirect}
+
+const virtualPortOpenVSwitch = "openvswitch"
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Parse a --kvm-vlan value, a single tag or a comma separated trunk list
+func parseVLANTags(value string) ([]int, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var tags []int
+	for _, s := range strings.Split(value, ",") {
+		tag, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid VLAN tag %q", s)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (d *Driver) networkMode() string {
+	if d.NetworkMode == "" {
+		return networkModeNetwork
+	}
+	return d.NetworkMode
+}
+
+// Check the public interface options and that the libvirt network, host
+// bridge or host device it connects to exists
+func (d *Driver) validatePublicInterface() error {
+	mode := d.networkMode()
+	if !oneOf(mode, networkModes) {
+		return fmt.Errorf("unsupported network mode %q, expected one of %v", mode, networkModes)
+	}
+	if d.Bridge != "" && mode != networkModeBridge {
+		return fmt.Errorf("--kvm-bridge needs network mode %s", networkModeBridge)
+	}
+	if d.HostInterface != "" && mode != networkModeDirect {
+		return fmt.Errorf("--kvm-host-interface needs network mode %s", networkModeDirect)
+	}
+	if d.OVSInterfaceID != "" && !uuidPattern.MatchString(d.OVSInterfaceID) {
+		return fmt.Errorf("Open vSwitch interface ID %q is not a UUID", d.OVSInterfaceID)
+	}
+	for _, tag := range d.VLANTags {
+		if tag < 0 || tag > 4095 {
+			return fmt.Errorf("VLAN tag %d out of range 0-4095", tag)
+		}
+	}
+	if d.Portgroup != "" && mode != networkModeNetwork {
+		return fmt.Errorf("--kvm-portgroup needs network mode %s", networkModeNetwork)
+	}
+	switch mode {
+	case networkModeBridge:
+		if d.Bridge == "" {
+			return fmt.Errorf("network mode %s needs --kvm-bridge", mode)
+		}
+		// Linux bridges have no VLAN support in libvirt
+		if len(d.VLANTags) > 0 && !d.OpenVSwitch {
+			return fmt.Errorf("VLAN tags on a bridge need --kvm-openvswitch")
+		}
+		return d.validateHostInterface(d.Bridge)
+	case networkModeDirect:
+		if d.HostInterface == "" {
+			return fmt.Errorf("network mode %s needs --kvm-host-interface", mode)
+		}
+		if d.OpenVSwitch || len(d.VLANTags) > 0 {
+			return fmt.Errorf("Open vSwitch and VLAN tags aren't supported in network mode %s", mode)
+		}
+		return d.validateHostInterface(d.HostInterface)
+	}
+	return d.validatePublicNetwork()
+}
+
+// Verify the libvirt network exists and has what the Open vSwitch, VLAN
+// and portgroup options expect
+func (d *Driver) validatePublicNetwork() error {
+	if err := d.validateNetwork(d.Network); err != nil {
+		return err
+	}
+	if !d.OpenVSwitch && len(d.VLANTags) == 0 && d.Portgroup == "" {
+		return nil
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	network, err := conn.LookupNetworkByName(d.Network)
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	xmldoc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	nw, err := parseNetworkXML(xmldoc)
+	if err != nil {
+		return err
+	}
+	ovs := nw.VirtualPort != nil && nw.VirtualPort.Type == virtualPortOpenVSwitch
+	if d.OpenVSwitch && !ovs {
+		return fmt.Errorf("network %s isn't an Open vSwitch network", d.Network)
+	}
+	if len(d.VLANTags) > 0 && !ovs {
+		return fmt.Errorf("VLAN tags need an Open vSwitch network, %s isn't one", d.Network)
+	}
+	if d.Portgroup != "" {
+		var names []string
+		for _, pg := range nw.Portgroups {
+			if pg.Name == d.Portgroup {
+				return nil
+			}
+			names = append(names, pg.Name)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("network %s has no portgroups", d.Network)
+		}
+		return fmt.Errorf("network %s has no portgroup %s, found: %s", d.Network, d.Portgroup, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Verify a bridge or device exists on the libvirtd host
+func (d *Driver) validateHostInterface(name string) error {
+	log.Debugf("Validating host interface %s", name)
+	if !d.isRemote() {
+		if _, err := net.InterfaceByName(name); err != nil {
+			return fmt.Errorf("host interface %s not found: %s", name, err)
+		}
+		return nil
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	iface, err := conn.LookupInterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("host interface %s not found on %s: %s", name, d.ConnectionString, err)
+	}
+	return iface.Free()
+}
+
+// The first NIC, which docker-machine doesn't talk to but which gives the
+// machine its outside connectivity
+func (d *Driver) publicInterface() domainInterface {
+	iface := d.networkInterface(d.Network, d.PublicMAC)
+	switch d.networkMode() {
+	case networkModeBridge:
+		iface.Type = networkModeBridge
+		iface.Source = domainInterfaceSource{Bridge: d.Bridge}
+	case networkModeDirect:
+		// In bridge mode guests reach each other, but not the host, through
+		// the device
+		iface.Type = networkModeDirect
+		iface.Source = domainInterfaceSource{Dev: d.HostInterface, Mode: "bridge"}
+		return iface
+	default:
+		iface.Source.Portgroup = d.Portgroup
+	}
+	if d.OpenVSwitch {
+		iface.VirtualPort = &domainVirtualPort{Type: virtualPortOpenVSwitch}
+		if d.OVSInterfaceID != "" {
+			iface.VirtualPort.Parameters = &domainVirtualPortParameters{InterfaceID: d.OVSInterfaceID}
+		}
+	}
+	if len(d.VLANTags) > 0 {
+		iface.VLAN = &domainVLAN{}
+		if len(d.VLANTags) > 1 {
+			iface.VLAN.Trunk = "yes"
+		}
+		for _, tag := range d.VLANTags {
+			iface.VLAN.Tags = append(iface.VLAN.Tags, domainVLANTag{ID: tag})
+		}
+	}
+	return iface
+}
@@ -0,0 +1,59 @@
+package kvm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVLANTags(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "42", want: []int{42}},
+		{value: "42,47, 100", want: []int{42, 47, 100}},
+		{value: "42,", wantErr: true},
+		{value: "vlan42", wantErr: true},
+		{value: "1-10", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseVLANTags(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVLANTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVLANTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Combinations of options rejected before anything is looked up
+func TestValidatePublicInterfaceOptions(t *testing.T) {
+	tests := []struct {
+		name   string
+		driver Driver
+	}{
+		{name: "unknown mode", driver: Driver{NetworkMode: "nat"}},
+		{name: "bridge without bridge mode", driver: Driver{Bridge: "br0"}},
+		{name: "host interface without direct mode", driver: Driver{NetworkMode: networkModeBridge, Bridge: "br0", HostInterface: "eth0"}},
+		{name: "interface ID not a UUID", driver: Driver{OpenVSwitch: true, OVSInterfaceID: "port1"}},
+		{name: "VLAN tag out of range", driver: Driver{VLANTags: []int{4096}}},
+		{name: "portgroup on a bridge", driver: Driver{NetworkMode: networkModeBridge, Bridge: "br0", Portgroup: "pg"}},
+		{name: "bridge mode without bridge", driver: Driver{NetworkMode: networkModeBridge}},
+		{name: "VLAN on a linux bridge", driver: Driver{NetworkMode: networkModeBridge, Bridge: "br0", VLANTags: []int{42}}},
+		{name: "direct without interface", driver: Driver{NetworkMode: networkModeDirect}},
+		{name: "VLAN in direct mode", driver: Driver{NetworkMode: networkModeDirect, HostInterface: "eth0", VLANTags: []int{42}}},
+		{name: "Open vSwitch in direct mode", driver: Driver{NetworkMode: networkModeDirect, HostInterface: "eth0", OpenVSwitch: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.driver.validatePublicInterface(); err == nil {
+				t.Error("validatePublicInterface() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package kvm
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// Changes to the private network apply right away and survive libvirtd
+// restarts
+const networkUpdateFlags = libvirt.NETWORK_UPDATE_AFFECT_LIVE | libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+
+// MAC address on the private network derived from the machine name, so a
+// machine that is recreated keeps its DHCP reservation
+func (d *Driver) privateMAC() string {
+	return derivedMAC(d.MachineName, 0)
+}
+
+// The n-th MAC address derived from name. Those after the first are only
+// used when it is taken
+func derivedMAC(name string, n int) string {
+	seed := name
+	if n > 0 {
+		seed = fmt.Sprintf("%s#%d", name, n)
+	}
+	sum := sha256.Sum256([]byte(seed))
+	return fmt.Sprintf("%s:%02x:%02x:%02x", qemuOUI, sum[0], sum[1], sum[2])
+}
+
+// First MAC address derived from name that isn't in used. Three bytes of
+// hash do collide once in a while on hosts with many machines
+func choosePrivateMAC(name string, used map[string]string) string {
+	for n := 0; ; n++ {
+		if mac := derivedMAC(name, n); used[mac] == "" {
+			return mac
+		}
+	}
+}
+
+// MAC addresses taken by others, with who takes them: reservations and
+// leases on the private network and the NICs of the other domains
+func (d *Driver) macsInUse() (map[string]string, error) {
+	network, nw, err := d.privateNetworkDef()
+	if err != nil {
+		return nil, err
+	}
+	defer network.Free()
+	used := map[string]string{}
+	if netIP := nw.ipv4(); netIP != nil {
+		for _, host := range netIP.dhcpHosts() {
+			if host.Name != d.MachineName {
+				used[strings.ToLower(host.MAC)] = "the DHCP reservation " + host.String()
+			}
+		}
+	}
+	leases, err := network.GetDHCPLeases()
+	if err != nil {
+		log.Debugf("Failed to get DHCP leases: %s", err)
+	}
+	for _, l := range leases {
+		if l.Hostname != d.MachineName {
+			used[strings.ToLower(l.Mac)] = "the DHCP lease of " + l.IPaddr
+		}
+	}
+
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	doms, err := conn.ListAllDomains(0)
+	if err != nil {
+		return nil, err
+	}
+	for i := range doms {
+		name, xmldoc, err := domainNameAndXML(&doms[i])
+		doms[i].Free()
+		if err != nil {
+			return nil, err
+		}
+		if name == d.MachineName {
+			continue
+		}
+		var dom domainDef
+		if err := xml.Unmarshal([]byte(xmldoc), &dom); err != nil {
+			return nil, err
+		}
+		for _, iface := range dom.Devices.Interfaces {
+			if iface.MAC != nil {
+				used[strings.ToLower(iface.MAC.Address)] = "domain " + name
+			}
+		}
+	}
+	return used, nil
+}
+
+func domainNameAndXML(dom *libvirt.Domain) (string, string, error) {
+	name, err := dom.GetName()
+	if err != nil {
+		return "", "", err
+	}
+	xmldoc, err := dom.GetXMLDesc(0)
+	return name, xmldoc, err
+}
+
+func (d *Driver) privateNetworkDef() (*libvirt.Network, *networkDef, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	network, err := conn.LookupNetworkByName(d.PrivateNetwork)
+	if err != nil {
+		return nil, nil, err
+	}
+	xmldoc, err := network.GetXMLDesc(0)
+	if err != nil {
+		network.Free()
+		return nil, nil, err
+	}
+	nw, err := parseNetworkXML(xmldoc)
+	if err != nil {
+		network.Free()
+		return nil, nil, err
+	}
+	return network, nw, nil
+}
+
+// Check --kvm-private-ip fits the private network and isn't reserved for
+// another machine
+func (d *Driver) validatePrivateIP() error {
+	if d.PrivateIP == "" {
+		return nil
+	}
+	ip := net.ParseIP(d.PrivateIP).To4()
+	if ip == nil {
+		return fmt.Errorf("invalid private IP address %q", d.PrivateIP)
+	}
+	network, nw, err := d.privateNetworkDef()
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	cidr := nw.ipv4Net()
+	if cidr == nil || !cidr.Contains(ip) {
+		return fmt.Errorf("private IP address %s isn't in private network %s (%s)", ip, d.PrivateNetwork, cidr)
+	}
+	first, last := subnetBounds(cidr)
+	if n := binary.BigEndian.Uint32(ip); n == first || n == last {
+		return fmt.Errorf("private IP address %s is the network or broadcast address of %s", ip, cidr)
+	}
+	netIP := nw.ipv4()
+	if ip.Equal(net.ParseIP(netIP.Address)) {
+		return fmt.Errorf("private IP address %s is the address of the host on %s", ip, d.PrivateNetwork)
+	}
+	mac := d.privateMAC()
+	for _, host := range netIP.dhcpHosts() {
+		if host.IP == ip.String() && !strings.EqualFold(host.MAC, mac) && host.Name != d.MachineName {
+			return fmt.Errorf("private IP address %s is reserved for %s already", ip, host)
+		}
+	}
+	return nil
+}
+
+// Add a DHCP host entry for the machine to the private network, replacing
+// any left behind by an earlier machine of the same name
+func (d *Driver) reservePrivateIP() error {
+	network, nw, err := d.privateNetworkDef()
+	if err != nil {
+		return err
+	}
+	defer network.Free()
+	netIP := nw.ipv4()
+	if netIP == nil || nw.ipv4Net() == nil {
+		return fmt.Errorf("%s network doesn't have DHCP configured properly", d.PrivateNetwork)
+	}
+	var stale *networkDHCPHost
+	for _, host := range netIP.dhcpHosts() {
+		if !strings.EqualFold(host.MAC, d.PrivateMAC) && host.Name != d.MachineName {
+			continue
+		}
+		if host.Name != d.MachineName {
+			return fmt.Errorf("MAC address %s of %s is reserved for %s already", d.PrivateMAC, d.MachineName, host)
+		}
+		host := host
+		stale = &host
+		break
+	}
+
+	ip := d.PrivateIP
+	if ip == "" && stale != nil {
+		ip = stale.IP
+	}
+	if ip == "" {
+		if ip, err = choosePrivateIP(d.PrivateNetwork, d.MachineName, netIP, leasedIPs(network)); err != nil {
+			return err
+		}
+
+	}
+	if stale != nil {
+		log.Debugf("Replacing DHCP reservation %s", stale)
+		if err := updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, *stale); err != nil {
+			return err
+		}
+	}
+	host := networkDHCPHost{MAC: d.PrivateMAC, Name: d.MachineName, IP: ip}
+	log.Infof("Reserving %s on network %s...", ip, d.PrivateNetwork)
+	if err := updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, host); err != nil {
+		return err
+	}
+	d.PrivateIP = ip
+	return nil
+}
+
+// Addresses with a DHCP lease on the network. Failing to get them is not
+// fatal, the reservation just may clash with a lease
+func leasedIPs(network *libvirt.Network) []string {
+	leases, err := network.GetDHCPLeases()
+	if err != nil {
+		log.Debugf("Failed to get DHCP leases: %s", err)
+	}
+	var ips []string
+	for _, l := range leases {
+		ips = append(ips, l.IPaddr)
+	}
+	return ips
+}
+
+// Pick an address in the DHCP range of netIP nobody has reserved or
+// leased, starting at one derived from the machine name so it tends to be
+// the same each time
+func choosePrivateIP(network, name string, netIP *networkIP, leased []string) (string, error) {
+	if netIP.DHCP == nil || len(netIP.DHCP.Ranges) == 0 {
+		return "", fmt.Errorf("%s network has no DHCP range to reserve an address in", network)
+	}
+	used := map[string]bool{netIP.Address: true}
+	for _, host := range netIP.dhcpHosts() {
+		used[host.IP] = true
+	}
+	for _, ip := range leased {
+		used[ip] = true
+	}
+	r := netIP.DHCP.Ranges[0]
+	start, end := net.ParseIP(r.Start).To4(), net.ParseIP(r.End).To4()
+	if start == nil || end == nil {
+		return "", fmt.Errorf("%s network has an invalid DHCP range %s-%s", network, r.Start, r.End)
+	}
+	first, last := binary.BigEndian.Uint32(start), binary.BigEndian.Uint32(end)
+	if last < first {
+		return "", fmt.Errorf("%s network has an invalid DHCP range %s-%s", network, r.Start, r.End)
+	}
+	size := last - first + 1
+	sum := sha256.Sum256([]byte(name))
+	offset := binary.BigEndian.Uint32(sum[:4]) % size
+	for i := uint32(0); i < size; i++ {
+		ip := uint32ToIP(first + (offset+i)%size).String()
+		if !used[ip] {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("no free address left in the DHCP range of %s network", network)
+}
+
+// Drop the DHCP host entry of the machine. Failing to is only worth a
+// warning, the machine is gone either way
+func (d *Driver) releasePrivateIP() {
+	if d.PrivateIP == "" || d.PrivateMAC == "" {
+		return
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return
+	}
+	network, err := conn.LookupNetworkByName(d.PrivateNetwork)
+	if err != nil {
+		log.Warnf("Unable to release %s: %s", d.PrivateIP, err)
+		return
+	}
+	defer network.Free()
+	host := networkDHCPHost{MAC: d.PrivateMAC, Name: d.MachineName, IP: d.PrivateIP}
+	if err := updateDHCPHost(network, libvirt.NETWORK_UPDATE_COMMAND_DELETE, host); err != nil {
+		log.Warnf("Unable to release %s: %s", d.PrivateIP, err)
+	}
+}
+
+func updateDHCPHost(network *libvirt.Network, cmd libvirt.NetworkUpdateCommand, host networkDHCPHost) error {
+	data, err := xml.Marshal(host)
+	if err != nil {
+		return err
+	}
+	return network.Update(cmd, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, string(data), networkUpdateFlags)
+}
@@ -0,0 +1,112 @@
+package kvm
+
+import (
+	"testing"
+)
+
+func TestChoosePrivateMAC(t *testing.T) {
+	first := derivedMAC("m1", 0)
+	second := derivedMAC("m1", 1)
+	if first == second {
+		t.Fatalf("derived MAC addresses are the same: %s", first)
+	}
+	tests := []struct {
+		name string
+		used map[string]string
+		want string
+	}{
+		{name: "free", used: map[string]string{}, want: first},
+		{name: "unrelated in use", used: map[string]string{"52:54:00:00:00:01": "domain m2"}, want: first},
+		{name: "collision", used: map[string]string{first: "domain m2"}, want: second},
+		{name: "two collisions", used: map[string]string{first: "domain m2", second: "domain m3"}, want: derivedMAC("m1", 2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := choosePrivateMAC("m1", tt.used); got != tt.want {
+				t.Errorf("choosePrivateMAC() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChoosePrivateIP(t *testing.T) {
+	dhcp := func(start, end string, hosts ...networkDHCPHost) *networkIP {
+		return &networkIP{
+			Address: "192.168.42.1",
+			Netmask: "255.255.255.0",
+			DHCP: &networkDHCP{
+				Ranges: []networkDHCPRange{{Start: start, End: end}},
+				Hosts:  hosts,
+			},
+		}
+	}
+	tests := []struct {
+		name    string
+		netIP   *networkIP
+		leased  []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "single address",
+			netIP: dhcp("192.168.42.10", "192.168.42.10"),
+			want:  "192.168.42.10",
+		},
+		{
+			name:  "skips reservations",
+			netIP: dhcp("192.168.42.10", "192.168.42.11", networkDHCPHost{MAC: "52:54:00:00:00:01", IP: "192.168.42.10"}),
+			want:  "192.168.42.11",
+		},
+		{
+			name:   "skips leases",
+			netIP:  dhcp("192.168.42.10", "192.168.42.11"),
+			leased: []string{"192.168.42.11"},
+			want:   "192.168.42.10",
+		},
+		{
+			name:  "skips the host address",
+			netIP: dhcp("192.168.42.1", "192.168.42.2"),
+			want:  "192.168.42.2",
+		},
+		{
+			name:    "range full",
+			netIP:   dhcp("192.168.42.10", "192.168.42.10"),
+			leased:  []string{"192.168.42.10"},
+			wantErr: true,
+		},
+		{
+			name:    "inverted range",
+			netIP:   dhcp("192.168.42.20", "192.168.42.10"),
+			wantErr: true,
+		},
+		{
+			name:    "invalid range",
+			netIP:   dhcp("192.168.42.x", "192.168.42.10"),
+			wantErr: true,
+		},
+		{
+			name:    "no DHCP",
+			netIP:   &networkIP{Address: "192.168.42.1", Netmask: "255.255.255.0"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := choosePrivateIP("docker-machines", "m1", tt.netIP, tt.leased)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("choosePrivateIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("choosePrivateIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// The same machine name starts at the same address each time
+	netIP := dhcp("192.168.42.2", "192.168.42.254")
+	a, _ := choosePrivateIP("docker-machines", "m1", netIP, nil)
+	b, _ := choosePrivateIP("docker-machines", "m1", netIP, nil)
+	if a != b {
+		t.Errorf("choosePrivateIP() not stable: %s, %s", a, b)
+	}
+}
@@ -0,0 +1,125 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/drivers"
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/state"
+)
+
+const (
+	// Printed by the grow script when the kernel kept the old partition
+	// table and the filesystem can only be grown after a reboot
+	growRebootMarker = "kvm-disk-grow: reboot"
+
+	// Grow the partition holding boot2docker-data to the end of the disk,
+	// then the ext4 filesystem on it. boot2docker puts swap first and the
+	// data partition last, so the partition can simply be recreated with
+	// the same start
+	growBoot2DockerScript = `set -e
+DEV=$(blkid -o device -l -t LABEL=boot2docker-data)
+if [ -z "$DEV" ]; then
+	echo "no boot2docker-data filesystem found" >&2
+	exit 1
+fi
+PART=$(basename "$DEV")
+DISK=/dev/$(basename "$(dirname "$(readlink -f /sys/class/block/$PART)")")
+NUM=$(cat /sys/class/block/$PART/partition)
+START=$(cat /sys/class/block/$PART/start)
+END=$((START + $(cat /sys/class/block/$PART/size)))
+if [ $END -lt $(($(cat /sys/class/block/${DISK#/dev/}/size) - 2048)) ]; then
+	if command -v growpart >/dev/null; then
+		sudo growpart "$DISK" "$NUM" || true
+	else
+		printf 'd\n%%s\nn\np\n%%s\n%%s\n\nw\n' "$NUM" "$NUM" "$START" | sudo fdisk -u "$DISK" || true
+	fi
+	sudo partx -u "$DISK" 2>/dev/null || sudo blockdev --rereadpt "$DISK" 2>/dev/null || true
+	if [ $((START + $(cat /sys/class/block/$PART/size))) -le $END ]; then
+		echo "%s"
+		exit 0
+	fi
+fi
+sudo resize2fs "$DEV"
+`
+)
+
+// ResizeDisk grows the machine disk to size MB. A running machine is
+// resized live, otherwise the volume or file is grown directly. The
+// filesystem of boot2docker machines is grown on their next start, cloud
+// images grow their root filesystem on every boot by themselves
+func (d *Driver) ResizeDisk(size int) error {
+	if size <= d.DiskSize {
+		return fmt.Errorf("disk of %s is %d MB already, it can only be grown", d.MachineName, d.DiskSize)
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return err
+	}
+	bytes := uint64(size) * 1000000
+	if s == state.Stopped {
+		err = d.resizeDiskOffline(bytes)
+	} else {
+		target := diskTarget(d.diskBus(), 0)
+		log.Infof("Resizing disk %s of running VM %s to %d MB...", target, d.MachineName, size)
+		err = d.VM.BlockResize(target, bytes, libvirt.DOMAIN_BLOCK_RESIZE_BYTES)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to resize disk of %s: %s", d.MachineName, err)
+	}
+	d.DiskSize = size
+	if d.CloudImage == "" {
+		d.PendingDiskGrowth = true
+		log.Infof("The filesystem of %s will be grown on its next start", d.MachineName)
+	}
+	return nil
+}
+
+func (d *Driver) resizeDiskOffline(bytes uint64) error {
+	if d.DiskVolume == "" {
+		path := d.layout().local(fmt.Sprintf("%s.img", d.MachineName))
+		log.Infof("Resizing disk image %s...", path)
+		return os.Truncate(path, int64(bytes))
+	}
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(d.DiskVolume)
+	if err != nil {
+		return err
+	}
+	defer vol.Free()
+	log.Infof("Resizing volume %s in storage pool %s...", d.DiskVolume, d.StoragePool)
+	return vol.Resize(bytes, 0)
+}
+
+// Grow the boot2docker data partition and filesystem after a resize. The
+// kernel may refuse to pick up the new partition table of the mounted
+// disk, the VM is then rebooted once to finish the job
+func (d *Driver) growDiskFilesystem() error {
+	log.Infof("Growing the filesystem of %s...", d.MachineName)
+	out, err := drivers.RunSSHCommandFromDriver(d, fmt.Sprintf(growBoot2DockerScript, growRebootMarker))
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(out))
+	}
+	if strings.Contains(out, growRebootMarker) {
+		if d.growRebooted {
+			return fmt.Errorf("the new partition table still isn't in use after a reboot")
+		}
+		log.Infof("Rebooting %s to use the grown partition...", d.MachineName)
+		d.growRebooted = true
+		return d.Restart()
+	}
+	log.Debugf("Grow output: %s", out)
+	d.PendingDiskGrowth = false
+	return nil
+}
@@ -0,0 +1,183 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+)
+
+// Snapshot describes a libvirt snapshot of the machine
+type Snapshot struct {
+	Name        string
+	Description string
+	Created     time.Time
+	// State of the VM when the snapshot was taken, e.g. running or shutoff
+	State   string
+	Current bool
+}
+
+// XML structure:
+//
+//	<domainsnapshot>
+//	    <name>before-upgrade</name>
+//	    <description>...</description>
+//	    <state>running</state>
+//	    <creationTime>1464094612</creationTime>
+//	    ...
+//	</domainsnapshot>
+type snapshotDef struct {
+	XMLName      xml.Name `xml:"domainsnapshot"`
+	Name         string   `xml:"name"`
+	Description  string   `xml:"description,omitempty"`
+	State        string   `xml:"state,omitempty"`
+	CreationTime int64    `xml:"creationTime,omitempty"`
+}
+
+// Internal snapshots need every writable disk to be qcow2
+func (d *Driver) checkSnapshotSupport() error {
+	if d.DiskFormat != diskFormatQcow2 {
+		return fmt.Errorf("snapshots need a qcow2 disk, create the machine with --kvm-storage-pool and --kvm-disk-format %s", diskFormatQcow2)
+	}
+	for _, disk := range d.ExtraDisks {
+		if disk.Format != diskFormatQcow2 {
+			return fmt.Errorf("snapshots need qcow2 disks, extra disk %s is %s", disk.Name, disk.Format)
+		}
+	}
+	return nil
+}
+
+// CreateSnapshot takes a snapshot of the machine's disk and, when it is
+// running, its memory
+func (d *Driver) CreateSnapshot(name, description string) error {
+	if err := d.checkSnapshotSupport(); err != nil {
+		return err
+	}
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if d.VM == nil {
+		return fmt.Errorf("domain %s not found", d.MachineName)
+	}
+	def, err := xml.Marshal(snapshotDef{Name: name, Description: description})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Creating snapshot %s of %s", name, d.MachineName)
+	snap, err := d.VM.CreateSnapshotXML(string(def), libvirt.DOMAIN_SNAPSHOT_CREATE_ATOMIC)
+	if err != nil {
+		return err
+	}
+	return snap.Free()
+}
+
+// ListSnapshots returns the snapshots of the machine
+func (d *Driver) ListSnapshots() ([]Snapshot, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if d.VM == nil {
+		return nil, fmt.Errorf("domain %s not found", d.MachineName)
+	}
+	snaps, err := d.VM.ListAllSnapshots(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range snaps {
+			snaps[i].Free()
+		}
+	}()
+
+	var list []Snapshot
+	for i := range snaps {
+		xmldoc, err := snaps[i].GetXMLDesc(0)
+		if err != nil {
+			return nil, err
+		}
+		var def snapshotDef
+		if err := xml.Unmarshal([]byte(xmldoc), &def); err != nil {
+			return nil, err
+		}
+		current, err := snaps[i].IsCurrent(0)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, Snapshot{
+			Name:        def.Name,
+			Description: def.Description,
+			Created:     time.Unix(def.CreationTime, 0),
+			State:       def.State,
+			Current:     current,
+		})
+	}
+	return list, nil
+}
+
+// RevertSnapshot puts the machine back in the state it had when the
+// snapshot was taken, including whether it was running
+func (d *Driver) RevertSnapshot(name string) error {
+	snap, err := d.lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snap.Free()
+	log.Debugf("Reverting %s to snapshot %s", d.MachineName, name)
+	if err := snap.RevertToSnapshot(0); err != nil {
+		return err
+	}
+	// The address may have changed along with the VM
+	d.IPAddress = ""
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot and its data
+func (d *Driver) DeleteSnapshot(name string) error {
+	snap, err := d.lookupSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer snap.Free()
+	log.Debugf("Deleting snapshot %s of %s", name, d.MachineName)
+	return snap.Delete(0)
+}
+
+func (d *Driver) lookupSnapshot(name string) (*libvirt.DomainSnapshot, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	if d.VM == nil {
+		return nil, fmt.Errorf("domain %s not found", d.MachineName)
+	}
+	snap, err := d.VM.SnapshotLookupByName(name, 0)
+	if err != nil {
+		if isLibvirtError(err, libvirt.ERR_NO_DOMAIN_SNAPSHOT) {
+			return nil, fmt.Errorf("machine %s has no snapshot %s", d.MachineName, name)
+		}
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Drop the snapshot metadata libvirt keeps for the domain, which would
+// otherwise make Undefine fail. The snapshot data goes away with the disk
+func (d *Driver) removeSnapshotMetadata() {
+	if d.VM == nil {
+		return
+	}
+	snaps, err := d.VM.ListAllSnapshots(0)
+	if err != nil {
+		log.Debugf("Failed to list snapshots: %s", err)
+		return
+	}
+	for i := range snaps {
+		name, _ := snaps[i].GetName()
+		if err := snaps[i].Delete(libvirt.DOMAIN_SNAPSHOT_DELETE_METADATA_ONLY); err != nil {
+			log.Warnf("Failed to remove metadata of snapshot %s: %s", name, err)
+		}
+		snaps[i].Free()
+	}
+}
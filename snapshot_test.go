@@ -0,0 +1,52 @@
+package kvm
+
+import (
+	"testing"
+
+	"github.com/rancher/machine/libmachine/drivers"
+)
+
+func TestCheckSnapshotSupport(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		extra   []ExtraDisk
+		wantErr bool
+	}{
+		{name: "raw disk", format: diskFormatRaw, wantErr: true},
+		{name: "qcow2 disk", format: diskFormatQcow2},
+		{name: "qcow2 extra disk", format: diskFormatQcow2, extra: []ExtraDisk{{Name: "data", Format: diskFormatQcow2}}},
+		{name: "raw extra disk", format: diskFormatQcow2, extra: []ExtraDisk{{Name: "data", Format: diskFormatRaw}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Driver{DiskFormat: tt.format, ExtraDisks: tt.extra}
+			err := d.checkSnapshotSupport()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// A machine whose domain is gone must fail cleanly rather than panic
+func TestSnapshotsWithoutDomain(t *testing.T) {
+	d := &Driver{
+		BaseDriver: &drivers.BaseDriver{MachineName: "gone"},
+		DiskFormat: diskFormatQcow2,
+		vmLoaded:   true,
+	}
+	if _, err := d.ListSnapshots(); err == nil {
+		t.Error("ListSnapshots: expected an error")
+	}
+	if err := d.CreateSnapshot("s1", ""); err == nil {
+		t.Error("CreateSnapshot: expected an error")
+	}
+	if err := d.RevertSnapshot("s1"); err == nil {
+		t.Error("RevertSnapshot: expected an error")
+	}
+	if err := d.DeleteSnapshot("s1"); err == nil {
+		t.Error("DeleteSnapshot: expected an error")
+	}
+	d.removeSnapshotMetadata()
+}
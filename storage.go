@@ -0,0 +1,338 @@
+package kvm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/mcnutils"
+)
+
+const (
+	diskFormatRaw   = "raw"
+	diskFormatQcow2 = "qcow2"
+
+	volumeXML = `<volume>
+  <name>%s</name>
+  <capacity unit='bytes'>%d</capacity>
+  <target>
+    <format type='%s'/>
+  </target>
+</volume>`
+	cloneVolumeXML = `<volume>
+  <name>%s</name>
+  <capacity unit='bytes'>%d</capacity>
+  <target>
+    <format type='qcow2'/>
+  </target>
+  <backingStore>
+    <path>%s</path>
+    <format type='qcow2'/>
+  </backingStore>
+</volume>`
+
+	// Size of the scratch volume the boot2docker payload is written to
+	// before it is converted into a qcow2 volume
+	payloadVolumeSize = 1 << 20
+)
+
+// XML structure:
+//
+//	<volume>
+//	    <name>machine.qcow2</name>
+//	    ...
+//	    <backingStore>
+//	        <path>/var/lib/libvirt/images/template-base.qcow2</path>
+//	        ...
+//	    </backingStore>
+//	</volume>
+type volumeDef struct {
+	Name         string `xml:"name"`
+	BackingStore struct {
+		Path string `xml:"path"`
+	} `xml:"backingStore"`
+}
+
+// Name of the machine disk inside the storage pool
+func (d *Driver) diskVolumeName() string {
+	if d.DiskFormat == diskFormatQcow2 {
+		return fmt.Sprintf("%s.qcow2", d.MachineName)
+	}
+	return fmt.Sprintf("%s.img", d.MachineName)
+}
+
+// Name of the boot ISO inside the storage pool
+func (d *Driver) isoVolumeName() string {
+	return fmt.Sprintf("%s-%s", d.MachineName, isoFilename)
+}
+
+func (d *Driver) diskSizeBytes() uint64 {
+	return uint64(d.DiskSize) * 1000000
+}
+
+func isLibvirtError(err error, code libvirt.ErrorNumber) bool {
+	lverr, ok := err.(libvirt.Error)
+	return ok && lverr.Code == code
+}
+
+func (d *Driver) getStoragePool() (*libvirt.StoragePool, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := conn.LookupStoragePoolByName(d.StoragePool)
+	if err != nil {
+		log.Errorf("Unable to locate storage pool %s", d.StoragePool)
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Verify the storage pool exists and is usable
+func (d *Driver) validateStoragePool() error {
+	switch d.DiskFormat {
+	case diskFormatRaw:
+	case diskFormatQcow2:
+		if d.StoragePool == "" {
+			return fmt.Errorf("disk format %s requires a storage pool, use --kvm-storage-pool", d.DiskFormat)
+		}
+	default:
+		return fmt.Errorf("unsupported disk format %q, expected %s or %s", d.DiskFormat, diskFormatRaw, diskFormatQcow2)
+	}
+	if d.StoragePool == "" {
+		return nil
+	}
+	log.Debugf("Validating storage pool %s", d.StoragePool)
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	active, err := pool.IsActive()
+	if err != nil {
+		return err
+	}
+	if !active {
+		return fmt.Errorf("storage pool %s is not active", d.StoragePool)
+	}
+	for _, name := range []string{d.DiskVolume, d.ISOVolume, d.SeedVolume, d.IgnitionVolume} {
+		if name == "" {
+			continue
+		}
+		if vol, err := pool.LookupStorageVolByName(name); err == nil {
+			vol.Free()
+			return fmt.Errorf("volume %s already exists in storage pool %s", name, d.StoragePool)
+		}
+	}
+	return nil
+}
+
+// Create the machine disk in the storage pool, with the boot2docker
+// "please format-me" payload at the start of the disk
+func (d *Driver) createDiskVolume() error {
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+
+	payload, err := mcnutils.MakeDiskImage(d.publicSSHKeyPath())
+	if err != nil {
+		return err
+	}
+
+	if d.DiskFormat == diskFormatRaw {
+		vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, d.DiskVolume, d.diskSizeBytes(), diskFormatRaw), 0)
+		if err != nil {
+			log.Warnf("Failed to create volume %s: %s", d.DiskVolume, err)
+			return err
+		}
+		defer vol.Free()
+		return d.uploadToVolume(vol, payload, uint64(payload.Len()))
+	}
+
+	// Writing the payload straight into a qcow2 volume would clobber the
+	// qcow2 header, so stage it in a raw volume and let libvirt convert it
+	scratchName := fmt.Sprintf("%s-payload.img", d.MachineName)
+	scratch, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, scratchName, payloadVolumeSize, diskFormatRaw), 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", scratchName, err)
+		return err
+	}
+	defer func() {
+		if err := scratch.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL); err != nil {
+			log.Warnf("Failed to delete volume %s: %s", scratchName, err)
+		}
+		scratch.Free()
+	}()
+	if err := d.uploadToVolume(scratch, payload, uint64(payload.Len())); err != nil {
+		return err
+	}
+	vol, err := pool.StorageVolCreateXMLFrom(fmt.Sprintf(volumeXML, d.DiskVolume, d.diskSizeBytes(), diskFormatQcow2), scratch, 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", d.DiskVolume, err)
+		return err
+	}
+	defer vol.Free()
+	// The converted volume inherits the size of the scratch volume
+	return vol.Resize(d.diskSizeBytes(), 0)
+}
+
+// Create the machine disk as a copy-on-write overlay of base, at least
+// DiskSize large
+func (d *Driver) createOverlayVolume(base *libvirt.StorageVol) error {
+	basePath, err := base.GetPath()
+	if err != nil {
+		return err
+	}
+	info, err := base.GetInfo()
+	if err != nil {
+		return err
+	}
+	capacity := d.diskSizeBytes()
+	if info.Capacity > capacity {
+		capacity = info.Capacity
+	}
+
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	vol, err := pool.StorageVolCreateXML(fmt.Sprintf(cloneVolumeXML, d.DiskVolume, capacity, basePath), 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", d.DiskVolume, err)
+		return err
+	}
+	return vol.Free()
+}
+
+// Names of the volumes in the pool using base as their backing file. They
+// are found by looking at the volumes themselves, so overlays made by
+// other machine stores are accounted for too
+func (d *Driver) volumesBackedBy(base *libvirt.StorageVol) ([]string, error) {
+	basePath, err := base.GetPath()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+	if err := pool.Refresh(0); err != nil {
+		return nil, err
+	}
+	vols, err := pool.ListAllStorageVolumes(0)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range vols {
+		xmldoc, err := vols[i].GetXMLDesc(0)
+		vols[i].Free()
+		if err != nil {
+			return nil, err
+		}
+		var vol volumeDef
+		if err := xml.Unmarshal([]byte(xmldoc), &vol); err != nil {
+			return nil, err
+		}
+		if vol.BackingStore.Path == basePath {
+			names = append(names, vol.Name)
+		}
+	}
+	return names, nil
+}
+
+// Create a raw volume holding a copy of the local file at path, so the
+// libvirtd host doesn't need access to the machine directory
+func (d *Driver) uploadFileToVolume(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	vol, err := pool.StorageVolCreateXML(fmt.Sprintf(volumeXML, name, fi.Size(), diskFormatRaw), 0)
+	if err != nil {
+		log.Warnf("Failed to create volume %s: %s", name, err)
+		return err
+	}
+	defer vol.Free()
+	log.Debugf("Uploading %s to volume %s", path, name)
+	if err := d.uploadToVolume(vol, f, uint64(fi.Size())); err != nil {
+		vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+		return err
+	}
+	return nil
+}
+
+// Stream length bytes from r into the start of vol
+func (d *Driver) uploadToVolume(vol *libvirt.StorageVol, r io.Reader, length uint64) error {
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return err
+	}
+	defer stream.Free()
+
+	if err := vol.Upload(stream, 0, length, 0); err != nil {
+		return err
+	}
+	chunk := make([]byte, 1<<20)
+	for {
+		n, err := r.Read(chunk)
+		if err != nil && err != io.EOF {
+			stream.Abort()
+			return err
+		}
+		for sent := 0; sent < n; {
+			m, err := stream.Send(chunk[sent:n])
+			if err != nil {
+				stream.Abort()
+				return err
+			}
+			sent += m
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return stream.Finish()
+}
+
+func (d *Driver) removeVolume(name string) error {
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	vol, err := pool.LookupStorageVolByName(name)
+	if err != nil {
+		if isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+			log.Debugf("Volume %s already removed", name)
+			return nil
+		}
+		return err
+	}
+	defer vol.Free()
+	log.Debugf("Deleting volume %s from storage pool %s", name, d.StoragePool)
+	return vol.Delete(libvirt.STORAGE_VOL_DELETE_NORMAL)
+}
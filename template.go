@@ -0,0 +1,215 @@
+package kvm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	libvirt "github.com/libvirt/libvirt-go"
+
+	"github.com/rancher/machine/libmachine/log"
+	"github.com/rancher/machine/libmachine/mcnutils"
+	"github.com/rancher/machine/libmachine/state"
+)
+
+const (
+	templatesDirname       = "kvm-templates"
+	templateConfigFilename = "template.json"
+)
+
+// Template is a fully provisioned machine disk kept in a storage pool as
+// the read-only base of copy-on-write clones. Its metadata and the SSH
+// key baked into it live in the docker-machine store
+type Template struct {
+	Name             string
+	ConnectionString string
+	StoragePool      string
+	Volume           string
+	SourceMachine    string
+
+	storePath string
+}
+
+func templateDir(storePath, name string) string {
+	return filepath.Join(storePath, templatesDirname, name)
+}
+
+// LoadTemplate reads the metadata of a template from the machine store
+func LoadTemplate(storePath, name string) (*Template, error) {
+	data, err := ioutil.ReadFile(filepath.Join(templateDir(storePath, name), templateConfigFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("template %s not found", name)
+		}
+		return nil, err
+	}
+	t := &Template{storePath: storePath}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("malformed template %s: %s", name, err)
+	}
+	return t, nil
+}
+
+// ListTemplates returns the templates in the machine store
+func ListTemplates(storePath string) ([]*Template, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(storePath, templatesDirname))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var templates []*Template
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		t, err := LoadTemplate(storePath, entry.Name())
+		if err != nil {
+			log.Warnf("Skipping template %s: %s", entry.Name(), err)
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+func (t *Template) save() error {
+	data, err := json.MarshalIndent(t, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(templateDir(t.storePath, t.Name), templateConfigFilename), data, 0600)
+}
+
+func (t *Template) sshKeyPath() string {
+	return filepath.Join(templateDir(t.storePath, t.Name), "id_rsa")
+}
+
+// A driver that only knows how to reach the template's pool
+func (t *Template) driver() *Driver {
+	return &Driver{
+		ConnectionString: t.ConnectionString,
+		StoragePool:      t.StoragePool,
+	}
+}
+
+func (t *Template) lookupVolume(d *Driver) (*libvirt.StorageVol, error) {
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free()
+	return pool.LookupStorageVolByName(t.Volume)
+}
+
+// Clones returns the names of the volumes in the pool backed by the
+// template, including clones made by other machine stores
+func (t *Template) Clones() ([]string, error) {
+	d := t.driver()
+	base, err := t.lookupVolume(d)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Free()
+	return d.volumesBackedBy(base)
+}
+
+// Delete removes the template, refusing to while clones depend on it
+func (t *Template) Delete() error {
+	clones, err := t.Clones()
+	if err != nil && !isLibvirtError(err, libvirt.ERR_NO_STORAGE_VOL) {
+		return err
+	}
+	if len(clones) > 0 {
+		return fmt.Errorf("template %s is still used by %s", t.Name, strings.Join(clones, ", "))
+	}
+	if err := t.driver().removeVolume(t.Volume); err != nil {
+		return err
+	}
+	return os.RemoveAll(templateDir(t.storePath, t.Name))
+}
+
+// CreateTemplate turns a copy of the machine's disk into a template new
+// machines can be cloned from. The machine has to be stopped so the copy
+// is consistent
+func (d *Driver) CreateTemplate(name string) error {
+	if d.StoragePool == "" || d.DiskFormat != diskFormatQcow2 {
+		return fmt.Errorf("templates need a qcow2 disk, create the machine with --kvm-storage-pool and --kvm-disk-format %s", diskFormatQcow2)
+	}
+	if _, err := LoadTemplate(d.StorePath, name); err == nil {
+		return fmt.Errorf("template %s already exists", name)
+	}
+	if s, err := d.GetState(); err != nil {
+		return err
+	} else if s != state.Stopped {
+		return errors.New("the machine has to be stopped to create a template from it")
+	}
+
+	t := &Template{
+		Name:             name,
+		ConnectionString: d.ConnectionString,
+		StoragePool:      d.StoragePool,
+		Volume:           fmt.Sprintf("template-%s.qcow2", name),
+		SourceMachine:    d.MachineName,
+		storePath:        d.StorePath,
+	}
+	pool, err := d.getStoragePool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free()
+	src, err := pool.LookupStorageVolByName(d.DiskVolume)
+	if err != nil {
+		return err
+	}
+	defer src.Free()
+	info, err := src.GetInfo()
+	if err != nil {
+		return err
+	}
+	log.Infof("Copying %s to template volume %s...", d.DiskVolume, t.Volume)
+	vol, err := pool.StorageVolCreateXMLFrom(fmt.Sprintf(volumeXML, t.Volume, info.Capacity, diskFormatQcow2), src, 0)
+	if err != nil {
+		return err
+	}
+	vol.Free()
+
+	// Clones boot with the key baked into the disk, keep it with the template
+	if err := os.MkdirAll(templateDir(d.StorePath, name), 0700); err != nil {
+		return err
+	}
+	for _, suffix := range []string{"", ".pub"} {
+		if err := mcnutils.CopyFile(d.GetSSHKeyPath()+suffix, t.sshKeyPath()+suffix); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(t.sshKeyPath(), 0600); err != nil {
+		return err
+	}
+	return t.save()
+}
+
+// Create the machine disk as a copy-on-write overlay of the template
+func (d *Driver) createCloneVolume(t *Template) error {
+	base, err := t.lookupVolume(d)
+	if err != nil {
+		return fmt.Errorf("unable to find volume %s of template %s: %s", t.Volume, t.Name, err)
+	}
+	defer base.Free()
+	return d.createOverlayVolume(base)
+}
+
+// Reuse the SSH key baked into the template's disk
+func (d *Driver) copyTemplateSSHKey(t *Template) error {
+	for _, suffix := range []string{"", ".pub"} {
+		if err := mcnutils.CopyFile(t.sshKeyPath()+suffix, d.GetSSHKeyPath()+suffix); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(d.GetSSHKeyPath(), 0600)
+}